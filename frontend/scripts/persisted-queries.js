@@ -0,0 +1,34 @@
+// Writes a manifest of every gql document in src, keyed by the SHA-256 hash
+// of the query exactly as Apollo Client sends it (with __typename added).
+// The server uses it when PERSISTED_QUERIES_ONLY=true.
+const crypto = require('crypto');
+const fs = require('fs');
+const path = require('path');
+const { parse, print } = require('graphql');
+const { addTypenameToDocument } = require('apollo-utilities');
+
+const srcDir = path.join(__dirname, '..', 'src');
+const output = process.argv[2] || path.join(__dirname, '..', 'persisted-queries.json');
+
+function findSources(dir) {
+  return fs.readdirSync(dir, { withFileTypes: true }).flatMap((entry) => {
+    const file = path.join(dir, entry.name);
+    if (entry.isDirectory()) {
+      return findSources(file);
+    }
+    return /\.(vue|js)$/.test(entry.name) ? [file] : [];
+  });
+}
+
+const manifest = {};
+for (const file of findSources(srcDir)) {
+  const source = fs.readFileSync(file, 'utf8');
+  for (const match of source.matchAll(/gql`([\s\S]*?)`/g)) {
+    const query = print(addTypenameToDocument(parse(match[1])));
+    const hash = crypto.createHash('sha256').update(query).digest('hex');
+    manifest[hash] = query;
+  }
+}
+
+fs.writeFileSync(output, `${JSON.stringify(manifest, null, 2)}\n`);
+console.log(`Wrote ${Object.keys(manifest).length} queries to ${output}`);
@@ -11,6 +11,7 @@ import 'bootstrap/scss/bootstrap.scss';
 import router from './router-guard';
 import App from './App.vue';
 import { AuthPlugin } from './auth';
+import { createPersistedQueryLink } from './persisted-queries';
 
 Vue.config.productionTip = false;
 
@@ -82,7 +83,8 @@ const link = split(
     }
   },
   wsLink,
-  httpLink
+  // Queries and mutations send the hash of the query first
+  createPersistedQueryLink().concat(httpLink)
 );
 
 const apolloClient = new ApolloClient({
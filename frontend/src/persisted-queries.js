@@ -0,0 +1,92 @@
+import { ApolloLink, Observable } from 'apollo-link';
+import { print } from 'graphql';
+
+// Automatic persisted queries: requests first send only the SHA-256 hash of
+// the query. If the server doesn't know the hash yet it answers
+// PersistedQueryNotFound and the request is repeated with the full query,
+// which also registers it. The hashes match the manifest written by
+// scripts/persisted-queries.js, so PERSISTED_QUERIES_ONLY works with either.
+
+const hashes = new WeakMap();
+
+function sha256(text) {
+  const data = new TextEncoder().encode(text);
+  return window.crypto.subtle.digest('SHA-256', data).then((digest) =>
+    Array.from(new Uint8Array(digest), (byte) => byte.toString(16).padStart(2, '0')).join(''));
+}
+
+function queryHash(query) {
+  if (!hashes.has(query)) {
+    hashes.set(query, sha256(print(query)));
+  }
+  return hashes.get(query);
+}
+
+function isNotFound(result) {
+  return Boolean(result && result.errors && result.errors.some((error) =>
+    error.message === 'PersistedQueryNotFound' ||
+    (error.extensions && error.extensions.code === 'PERSISTED_QUERY_NOT_FOUND')));
+}
+
+export function createPersistedQueryLink() {
+  // crypto.subtle only exists in secure contexts (HTTPS and localhost),
+  // elsewhere queries are always sent in full
+  if (!window.crypto || !window.crypto.subtle) {
+    return new ApolloLink((operation, forward) => forward(operation));
+  }
+
+  return new ApolloLink((operation, forward) => new Observable((observer) => {
+    let subscription;
+    let closed = false;
+
+    const send = (includeQuery) => {
+      let retried = false;
+      const retry = () => {
+        retried = true;
+        send(true);
+      };
+      operation.setContext({ http: { includeQuery, includeExtensions: true } });
+      subscription = forward(operation).subscribe({
+        next(result) {
+          if (!includeQuery && isNotFound(result)) {
+            retry();
+          } else {
+            observer.next(result);
+          }
+        },
+        error(error) {
+          // The server may answer an unknown hash with an error status
+          if (!includeQuery && isNotFound(error.result)) {
+            retry();
+          } else {
+            observer.error(error);
+          }
+        },
+        complete() {
+          if (!retried) {
+            observer.complete();
+          }
+        },
+      });
+    };
+
+    queryHash(operation.query).then((sha256Hash) => {
+      if (closed) {
+        return;
+      }
+      operation.extensions.persistedQuery = { version: 1, sha256Hash };
+      send(false);
+    }, () => {
+      if (!closed) {
+        send(true);
+      }
+    });
+
+    return () => {
+      closed = true;
+      if (subscription) {
+        subscription.unsubscribe();
+      }
+    };
+  }));
+}
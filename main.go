@@ -1,50 +1,105 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/tinrab/graphql-realtime-chat/server"
+	"github.com/tinrab/graphql-realtime-chat/web"
 )
 
-type config struct {
-	RedisURL string `envconfig:"REDIS_URL"`
-}
-
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML (.toml) config file")
+	listenAddr := flag.String("listen", "", "address to listen on, overrides LISTEN_ADDR")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	flag.Parse()
+
 	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Printf("No .env file found")
-	}
+	envErr := godotenv.Load()
 
-	var cfg config
-	err := envconfig.Process("", &cfg)
+	cfg, err := server.LoadConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
+	if *listenAddr != "" {
+		cfg.ListenAddr = *listenAddr
 	}
 
-	// Debug environment variables
-	log.Printf("[DEBUG] Environment variables:")
-	log.Printf("GitHub Client ID: %s", os.Getenv("GITHUB_CLIENT_ID"))
-	log.Printf("GitHub Client Secret length: %d", len(os.Getenv("GITHUB_CLIENT_SECRET")))
-	log.Printf("Redis URL: %s", redisURL)
+	if *printConfig {
+		if err := cfg.Redacted().WriteYAML(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	s, err := server.NewServer(redisURL)
+	logger, err := server.NewLogger(os.Stderr, &cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	slog.SetDefault(logger)
 
-	log.Printf("[DEBUG] Server created successfully")
+	if envErr != nil {
+		slog.Debug("No .env file found")
+	}
 
-	err = s.Serve(8080)
+	shutdownTracing, err := server.SetupTracing(context.Background(), &cfg)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if len(cfg.OAuthProviders()) == 0 {
+		slog.Warn("No OAuth provider is configured, logins will fail")
+	}
+
+	s, err := server.NewServer(&cfg, web.Assets())
+	if err != nil {
+		fatal(err)
 	}
+
+	slog.Info("Server created", "addr", cfg.ListenAddr, "url", cfg.BaseURL)
+
+	// fly.io sends SIGINT by default, other platforms SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			fatal(err)
+		}
+		return
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown failed", "error", err)
+	}
+	if err := <-serveErr; err != nil {
+		slog.Error("Serve failed", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/ksuid"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	maxAttachmentSize        = 10 << 20
+	maxAttachmentsPerMessage = 5
+	maxThumbnailSourcePixels = 40_000_000
+	thumbnailSize            = 256
+)
+
+// allowedAttachmentTypes lists the sniffed MIME types accepted for upload
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"text/plain":      true,
+	"application/pdf": true,
+	"application/zip": true,
+}
+
+// storedAttachment is the metadata kept in Redis, which also remembers the
+// message so downloads can follow its visibility
+type storedAttachment struct {
+	Attachment
+	MessageID string `json:"messageId,omitempty"`
+}
+
+func attachmentKey(id string) string {
+	return "attachment:" + id
+}
+
+func attachmentBlobKey(id, variant string) string {
+	return "attachments/" + id + "/" + variant
+}
+
+// saveAttachments validates and stores every upload of a message
+func (r *Resolver) saveAttachments(ctx context.Context, messageID string, uploads []*graphql.Upload) ([]*Attachment, error) {
+	if len(uploads) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("at most %d attachments are allowed per message", maxAttachmentsPerMessage)
+	}
+	if len(uploads) > 0 && r.blobs == nil {
+		return nil, errors.New("attachments are not enabled")
+	}
+
+	attachments := make([]*Attachment, 0, len(uploads))
+	for _, upload := range uploads {
+		attachment, err := r.saveAttachment(ctx, messageID, upload)
+		if err != nil {
+			r.deleteAttachments(ctx, attachments)
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+func (r *Resolver) saveAttachment(ctx context.Context, messageID string, upload *graphql.Upload) (*Attachment, error) {
+	if upload.Size > maxAttachmentSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", upload.Filename, maxAttachmentSize)
+	}
+
+	// Never trust the client-provided size, read at most one byte past the limit
+	data, err := io.ReadAll(io.LimitReader(upload.File, maxAttachmentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAttachmentSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", upload.Filename, maxAttachmentSize)
+	}
+
+	// Sniff the type from the content instead of trusting the client header
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !allowedAttachmentTypes[contentType] {
+		return nil, fmt.Errorf("%s: file type %s is not allowed", upload.Filename, contentType)
+	}
+
+	id := ksuid.New().String()
+	attachment := &Attachment{
+		ID:          id,
+		Filename:    sanitizeFilename(upload.Filename),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		URL:         "/attachments/" + id,
+	}
+
+	if err := r.blobs.Put(ctx, attachmentBlobKey(id, "original"), data, contentType); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		thumbnail, err := makeThumbnail(data)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to create thumbnail", "attachment", id, "error", err)
+		} else if err := r.blobs.Put(ctx, attachmentBlobKey(id, "thumbnail"), thumbnail, "image/png"); err != nil {
+			slog.ErrorContext(ctx, "Failed to store thumbnail", "attachment", id, "error", err)
+		} else {
+			thumbnailURL := attachment.URL + "/thumbnail"
+			attachment.ThumbnailURL = &thumbnailURL
+		}
+	}
+
+	attachmentJSON, err := json.Marshal(storedAttachment{Attachment: *attachment, MessageID: messageID})
+	if err == nil {
+		err = r.redis.Set(ctx, attachmentKey(id), attachmentJSON, 0).Err()
+	}
+	if err != nil {
+		r.deleteAttachments(ctx, []*Attachment{attachment})
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// deleteAttachments removes the blobs and metadata of attachments whose
+// message was deleted or never posted, such as when it was rejected.
+// Failures are only logged, there is nothing left to refer to them.
+func (r *Resolver) deleteAttachments(ctx context.Context, attachments []*Attachment) {
+	// Clean up even if the request that uploaded them was cancelled
+	ctx = context.WithoutCancel(ctx)
+	for _, attachment := range attachments {
+		if r.blobs != nil {
+			for _, variant := range []string{"original", "thumbnail"} {
+				if err := r.blobs.Delete(ctx, attachmentBlobKey(attachment.ID, variant)); err != nil {
+					slog.ErrorContext(ctx, "Failed to delete attachment", "attachment", attachment.ID, "variant", variant, "error", err)
+				}
+			}
+		}
+		if err := r.redis.Del(ctx, attachmentKey(attachment.ID)).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete attachment", "attachment", attachment.ID, "error", err)
+		}
+	}
+}
+
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '"' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// makeThumbnail scales an image down to fit within thumbnailSize and encodes it as PNG
+func makeThumbnail(data []byte) ([]byte, error) {
+	// Check the dimensions first so huge images can't exhaust memory when decoded
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("image is too large for a thumbnail (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, errors.New("image is empty")
+	}
+
+	thumbWidth, thumbHeight := width, height
+	if width > thumbnailSize || height > thumbnailSize {
+		if width >= height {
+			thumbWidth = thumbnailSize
+			thumbHeight = max(1, height*thumbnailSize/width)
+		} else {
+			thumbHeight = thumbnailSize
+			thumbWidth = max(1, width*thumbnailSize/height)
+		}
+	}
+
+	// Nearest-neighbour sampling is good enough for chat previews
+	dst := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		for x := 0; x < thumbWidth; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*width/thumbWidth, bounds.Min.Y+y*height/thumbHeight))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleAttachment serves /attachments/{id} and /attachments/{id}/thumbnail to
+// users with a session or an access token
+func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ClientFromContext(r.Context()).User == "" {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if s.blobs == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/attachments/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "thumbnail") {
+		http.NotFound(w, r)
+		return
+	}
+	id := parts[0]
+
+	attachmentJSON, err := s.redis.Get(r.Context(), attachmentKey(id)).Result()
+	if err == redis.Nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+
+	var attachment storedAttachment
+	if err := json.Unmarshal([]byte(attachmentJSON), &attachment); err != nil {
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+
+	// Attachments of hidden messages are hidden as well, except from admins
+	if attachment.MessageID != "" {
+		msg, err := s.resolver.loadMessage(r.Context(), attachment.MessageID)
+		if errors.Is(err, errMessageNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+			return
+		}
+		if msg.Hidden && s.resolver.hasRole(r.Context(), RoleAdmin) != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	variant, contentType := "original", attachment.ContentType
+	if len(parts) == 2 {
+		if attachment.ThumbnailURL == nil {
+			http.NotFound(w, r)
+			return
+		}
+		variant, contentType = "thumbnail", "image/png"
+	}
+
+	blob, err := s.blobs.Get(r.Context(), attachmentBlobKey(id, variant))
+	if errors.Is(err, ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if variant == "original" {
+		w.Header().Set("Content-Length", fmt.Sprint(attachment.Size))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, blob)
+}
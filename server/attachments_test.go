@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const postAttachmentMutation = `mutation($user: String!, $text: String!, $files: [Upload!]) {
+	postMessage(user: $user, text: $text, attachments: $files) { id attachments { url } }
+}`
+
+// postAttachment posts a message with one file as a GraphQL multipart request
+func postAttachment(t *testing.T, s *Server, user, text string, file []byte) *graphqlResult {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	operations, _ := json.Marshal(map[string]interface{}{
+		"query":     postAttachmentMutation,
+		"variables": map[string]interface{}{"user": user, "text": text, "files": []interface{}{nil}},
+	})
+	form.WriteField("operations", string(operations))
+	form.WriteField("map", `{"0": ["variables.files.0"]}`)
+	part, _ := form.CreateFormFile("0", "notes.txt")
+	part.Write(file)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/graphql", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.AddCookie(sessionFor(s, user))
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	var result graphqlResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	return &result
+}
+
+// postedAttachment posts a message with one attachment and returns the IDs
+// of both and the download URL
+func postedAttachment(t *testing.T, s *Server, user, text string) (messageID, url string) {
+	t.Helper()
+	result := postAttachment(t, s, user, text, []byte("some plain text notes"))
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	var data struct {
+		PostMessage struct {
+			ID          string
+			Attachments []struct{ URL string }
+		}
+	}
+	if err := json.Unmarshal(result.Data, &data); err != nil || len(data.PostMessage.Attachments) != 1 {
+		t.Fatalf("%s: %v", result.Data, err)
+	}
+	return data.PostMessage.ID, data.PostMessage.Attachments[0].URL
+}
+
+// downloadStatus fetches url as user and returns the status code
+func downloadStatus(s *Server, user, url string) int {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.AddCookie(sessionFor(s, user))
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAttachmentDownloadRequiresSession(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	_, url := postedAttachment(t, s, "alice", "my notes")
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"display cookie", &http.Cookie{Name: displayCookie, Value: "alice"}, http.StatusUnauthorized},
+		{"forged session", &http.Cookie{Name: sessionCookie, Value: "alice.9999999999.forged"}, http.StatusUnauthorized},
+		{"session", sessionFor(s, "bob"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, url, nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			s.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != "some plain text notes" {
+				t.Errorf("body %q", rec.Body)
+			}
+		})
+	}
+}
+
+func TestRejectedMessageDeletesAttachments(t *testing.T) {
+	s, mr := newTestServer(t, nil)
+	postTestMessage(t, s, "alice", "the same message twice")
+
+	result := postAttachment(t, s, "alice", "the same message twice", []byte("some plain text notes"))
+	if code := result.errorCode(); code != "MESSAGE_REJECTED" {
+		t.Fatalf("error code %q, want MESSAGE_REJECTED", code)
+	}
+
+	if keys := mr.Keys(); strings.Contains(strings.Join(keys, " "), "attachment:") {
+		t.Errorf("attachment metadata left in Redis: %v", keys)
+	}
+	filepath.WalkDir(s.config.BlobDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("blob left behind: %s", path)
+		}
+		return err
+	})
+}
+
+func TestRemovedMessageAttachments(t *testing.T) {
+	s := newModerationServer(t)
+	ctx := context.Background()
+
+	// Deleted messages take their attachments with them
+	deletedID, deletedURL := postedAttachment(t, s, "alice", "my notes")
+	msg, err := s.resolver.loadMessage(ctx, deletedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.resolver.deleteMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// So do messages an admin rejects
+	rejectedID, rejectedURL := postedAttachment(t, s, "alice", "my spamword notes")
+	result := doGraphQL(t, s, `mutation($id: ID!) { resolveModeration(id: $id, decision: REJECT) }`,
+		map[string]interface{}{"id": rejectedID}, sessionFor(s, "owner"))
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	for _, url := range []string{deletedURL, rejectedURL} {
+		if status := downloadStatus(s, "owner", url); status != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", url, status)
+		}
+	}
+	filepath.WalkDir(s.config.BlobDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("blob left behind: %s", path)
+		}
+		return err
+	})
+
+	// Attachments of hidden messages are only visible to admins
+	hiddenID, hiddenURL := postedAttachment(t, s, "alice", "more notes")
+	if msg, err = s.resolver.loadMessage(ctx, hiddenID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.resolver.hideMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	for user, status := range map[string]int{"alice": http.StatusNotFound, "bob": http.StatusNotFound, "owner": http.StatusOK} {
+		if got := downloadStatus(s, user, hiddenURL); got != status {
+			t.Errorf("hidden message, %s: status %d, want %d", user, got, status)
+		}
+	}
+}
+
+func TestImageThumbnails(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 600, 300))
+	var pngFile, jpegFile bytes.Buffer
+	if err := png.Encode(&pngFile, source); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpegFile, source, nil); err != nil {
+		t.Fatal(err)
+	}
+	webpFile, err := os.ReadFile("testdata/gopher.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestServer(t, nil)
+	for name, file := range map[string][]byte{"png": pngFile.Bytes(), "jpeg": jpegFile.Bytes(), "webp": webpFile} {
+		t.Run(name, func(t *testing.T) {
+			result := postAttachment(t, s, "alice", "a picture in "+name, file)
+			if len(result.Errors) > 0 {
+				t.Fatal(result.Errors)
+			}
+			var data struct {
+				PostMessage struct{ ID string }
+			}
+			json.Unmarshal(result.Data, &data)
+			msg, err := s.resolver.loadMessage(context.Background(), data.PostMessage.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Attachments) != 1 || msg.Attachments[0].ThumbnailURL == nil {
+				t.Fatalf("attachments %+v, want one with a thumbnail", msg.Attachments)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, *msg.Attachments[0].ThumbnailURL, nil)
+			req.AddCookie(sessionFor(s, "alice"))
+			rec := httptest.NewRecorder()
+			s.handler.ServeHTTP(rec, req)
+			thumbnail, err := png.Decode(rec.Body)
+			if rec.Code != http.StatusOK || err != nil {
+				t.Fatalf("thumbnail: status %d, %v", rec.Code, err)
+			}
+			if size := thumbnail.Bounds().Size(); size.X > thumbnailSize || size.Y > thumbnailSize {
+				t.Errorf("thumbnail is %v, want it to fit in %d", size, thumbnailSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	auditStream = "audit"
+	// maxAuditScan bounds how many entries a filtered query looks at
+	maxAuditScan = 10000
+)
+
+// AuditEvent is a security relevant action recorded in the audit log
+type AuditEvent struct {
+	ID        string  `json:"id"`
+	Action    string  `json:"action"`
+	Actor     string  `json:"actor"`
+	Target    *string `json:"target,omitempty"`
+	Detail    *string `json:"detail,omitempty"`
+	IP        string  `json:"ip"`
+	UserAgent string  `json:"userAgent"`
+	CreatedAt Time    `json:"createdAt"`
+}
+
+// AuditLog appends events to a Redis stream and, optionally, a JSON Lines file
+type AuditLog struct {
+	redis *redis.Client
+
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewAuditLog creates an audit log, mirroring events to path if it isn't empty
+func NewAuditLog(redisClient *redis.Client, path string) (*AuditLog, error) {
+	a := &AuditLog{redis: redisClient}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+// Record appends an event. IP and user agent are taken from the request context.
+func (a *AuditLog) Record(ctx context.Context, action, actor, target, detail string) {
+	if a == nil {
+		return
+	}
+	client := ClientFromContext(ctx)
+	event := &AuditEvent{
+		Action:    action,
+		Actor:     actor,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		CreatedAt: Time{Time: time.Now()},
+	}
+	if target != "" {
+		event.Target = &target
+	}
+	if detail != "" {
+		event.Detail = &detail
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// Audit entries must not get lost because the request was cancelled
+	ctx = context.WithoutCancel(ctx)
+	id, err := a.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditStream,
+		Values: map[string]interface{}{"event": eventJSON},
+	}).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to write audit event", "action", action, "error", err)
+	}
+
+	// Close may run concurrently and clear the file
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file != nil {
+		event.ID = id
+		line, _ := json.Marshal(event)
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			slog.ErrorContext(ctx, "Failed to write audit event to file", "action", action, "error", err)
+		}
+	}
+}
+
+// Close closes the mirror file, if any
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func decodeAuditEvent(msg redis.XMessage) (*AuditEvent, error) {
+	raw, _ := msg.Values["event"].(string)
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		return nil, err
+	}
+	event.ID = msg.ID
+	return &event, nil
+}
+
+func (f *AuditLogFilter) matches(event *AuditEvent) bool {
+	if f == nil {
+		return true
+	}
+	if f.Action != nil && *f.Action != event.Action {
+		return false
+	}
+	if f.Actor != nil && *f.Actor != event.Actor {
+		return false
+	}
+	if f.Target != nil && (event.Target == nil || *f.Target != *event.Target) {
+		return false
+	}
+	if f.Since != nil && event.CreatedAt.Before(f.Since.Time) {
+		return false
+	}
+	if f.Until != nil && event.CreatedAt.After(f.Until.Time) {
+		return false
+	}
+	return true
+}
+
+// previousStreamID returns the ID right before id, so XREVRANGE can resume
+// after a cursor without the exclusive range syntax of Redis 6.2
+func previousStreamID(id string) (string, error) {
+	msPart, seqPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return "", fmt.Errorf("invalid cursor %q", id)
+	}
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor %q", id)
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor %q", id)
+	}
+	if seq > 0 {
+		return fmt.Sprintf("%d-%d", ms, seq-1), nil
+	}
+	if ms == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("%d-%d", ms-1, uint64(1<<64-1)), nil
+}
+
+// Query returns up to first events matching filter, newest first, starting
+// after the cursor
+func (a *AuditLog) Query(ctx context.Context, filter *AuditLogFilter, first int, after *string) (*AuditLogConnection, error) {
+	first = min(max(first, 1), maxListSize)
+	conn := &AuditLogConnection{Entries: []*AuditEvent{}}
+
+	end := "+"
+	if after != nil && *after != "" {
+		prev, err := previousStreamID(*after)
+		if err != nil {
+			return nil, err
+		}
+		if prev == "" {
+			return conn, nil
+		}
+		end = prev
+	}
+
+	for scanned := 0; scanned < maxAuditScan; {
+		batch, err := a.redis.XRevRangeN(ctx, auditStream, end, "-", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return conn, nil
+		}
+		scanned += len(batch)
+
+		for _, msg := range batch {
+			event, err := decodeAuditEvent(msg)
+			if err != nil || !filter.matches(event) {
+				continue
+			}
+			if len(conn.Entries) == first {
+				conn.HasNextPage = true
+				return conn, nil
+			}
+			conn.Entries = append(conn.Entries, event)
+			conn.EndCursor = &event.ID
+		}
+
+		prev, err := previousStreamID(batch[len(batch)-1].ID)
+		if err != nil || prev == "" {
+			return conn, err
+		}
+		end = prev
+	}
+	return conn, nil
+}
+
+// handleAuditExport streams the whole audit log as JSON Lines, oldest first
+func (s *Server) handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	if err := s.resolver.hasRole(r.Context(), RoleAdmin); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+
+	encoder := json.NewEncoder(w)
+	start := "-"
+	for {
+		batch, err := s.redis.XRangeN(r.Context(), auditStream, start, "+", 500).Result()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to export audit log", "error", err)
+			return
+		}
+		for _, msg := range batch {
+			if event, err := decodeAuditEvent(msg); err == nil {
+				encoder.Encode(event)
+			}
+		}
+		if len(batch) < 500 {
+			return
+		}
+		start = nextStreamID(batch[len(batch)-1].ID)
+	}
+}
+
+// nextStreamID returns the ID right after id
+func nextStreamID(id string) string {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	return msPart + "-" + strconv.FormatUint(seq+1, 10)
+}
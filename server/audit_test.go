@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestAuditRecordDuringClose is meant to run with -race
+func TestAuditRecordDuringClose(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	audit, err := NewAuditLog(s.redis, filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			audit.Record(context.Background(), "LOGIN", "alice", "", "")
+		}()
+	}
+	if err := audit.Close(); err != nil {
+		t.Error(err)
+	}
+	wg.Wait()
+}
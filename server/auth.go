@@ -1,117 +1,274 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
 	"net/http"
-	"os"
+	"net/url"
+	"time"
 
+	githubapi "github.com/google/go-github/v32/github"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 )
 
-var (
-	oauthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
-		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
-		RedirectURL:  "http://localhost:8080/auth/github/callback",
+// OAuthProvider is an external account service users can log in with
+type OAuthProvider interface {
+	// Name is used in the login URLs, metrics and the audit log
+	Name() string
+	// OAuth2Config returns the client settings with redirectURL as callback
+	OAuth2Config(redirectURL string) *oauth2.Config
+	// Login returns the chat username of the account client is authorized for
+	Login(ctx context.Context, client *http.Client) (string, error)
+}
+
+// gitHubProvider logs users in with their GitHub login as username
+type gitHubProvider struct {
+	clientID     string
+	clientSecret string
+}
+
+func (p *gitHubProvider) Name() string {
+	return "github"
+}
+
+func (p *gitHubProvider) OAuth2Config(redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  redirectURL,
 		Scopes: []string{
 			"user:email",
 			"read:user",
 		},
 		Endpoint: github.Endpoint,
 	}
-)
-
-type GitHubUser struct {
-	ID        int    `json:"id"`
-	Login     string `json:"login"`
-	AvatarURL string `json:"avatar_url"`
-	Name      string `json:"name"`
-	Email     string `json:"email"`
 }
 
-func init() {
-	log.Printf("Initializing OAuth config...")
-	log.Printf("Redirect URL: %s", "http://localhost:8080/auth/github/callback")
+func (p *gitHubProvider) Login(ctx context.Context, client *http.Client) (string, error) {
+	user, _, err := githubapi.NewClient(client).Users.Get(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	if user.GetLogin() == "" {
+		return "", errors.New("GitHub user has no login")
+	}
+	return user.GetLogin(), nil
 }
 
-func (s *Server) handleGitHubLogin(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GitHub login handler called")
-	log.Printf("Method: %s", r.Method)
-	log.Printf("URL: %s", r.URL.String())
+// gitLabSuffix marks GitLab accounts. GitHub logins can't contain "@", so
+// a GitLab user can't take over the GitHub account of the same name.
+const gitLabSuffix = "@gitlab"
 
-	url := oauthConfig.AuthCodeURL("state")
-	log.Printf("Generated GitHub OAuth URL: %s", url)
+// gitLabProvider logs users in with gitlab.com or a self-hosted GitLab
+type gitLabProvider struct {
+	clientID     string
+	clientSecret string
+	baseURL      string
+}
 
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-	log.Printf("Redirected to GitHub")
+func (p *gitLabProvider) Name() string {
+	return "gitlab"
 }
 
-func (s *Server) handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
-	// Enable CORS for the callback
-	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+func (p *gitLabProvider) OAuth2Config(redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"read_user"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.baseURL + "/oauth/authorize",
+			TokenURL: p.baseURL + "/oauth/token",
+		},
+	}
+}
 
-	code := r.URL.Query().Get("code")
-	token, err := oauthConfig.Exchange(r.Context(), code)
+func (p *gitLabProvider) Login(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/api/v4/user", nil)
 	if err != nil {
-		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
-		return
+		return "", err
 	}
-
-	client := oauthConfig.Client(r.Context(), token)
-	resp, err := client.Get("https://api.github.com/user")
+	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
-		return
+		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitLab user API returned %s", resp.Status)
+	}
 
-	var githubUser GitHubUser
-	if err := json.NewDecoder(resp.Body).Decode(&githubUser); err != nil {
-		http.Error(w, "Failed to decode user info", http.StatusInternalServerError)
-		return
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", err
 	}
+	if user.Username == "" {
+		return "", errors.New("GitLab user has no username")
+	}
+	return user.Username + gitLabSuffix, nil
+}
+
+// callbackPage sets the frontend's user cookie from JavaScript as well and
+// continues to the frontend. Values are escaped for the script context.
+var callbackPage = template.Must(template.New("callback").Parse(`<!DOCTYPE html>
+<html>
+<body>
+	<script nonce="{{.Nonce}}">
+		document.cookie = {{.Cookie}};
+		window.location.href = {{.Redirect}};
+	</script>
+</body>
+</html>
+`))
 
-	// Set cookie with proper settings
-	http.SetCookie(w, &http.Cookie{
-		Name:     "user_id",
-		Value:    githubUser.Login,
-		Path:     "/",
-		Domain:   "localhost",
-		MaxAge:   3600 * 24, // 24 hours
-		HttpOnly: false,     // Changed to false so JavaScript can read it
-		Secure:   false,
+// oauthCallbackURL is where the provider redirects back to after the login
+func (s *Server) oauthCallbackURL(provider OAuthProvider) string {
+	return s.config.BaseURL + "/auth/" + provider.Name() + "/callback"
+}
+
+// oauthStateCookie holds the state of a login in progress. The callback
+// only accepts the state it was sent to, so other sites can't log visitors
+// in to an account of their choosing.
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateMaxAge = 10 * time.Minute
+)
+
+// oauthStateCookieFor returns the state cookie, scoped to the provider's
+// login and callback URLs. An empty value deletes it.
+func (s *Server) oauthStateCookieFor(provider OAuthProvider, value string) *http.Cookie {
+	maxAge := int(oauthStateMaxAge.Seconds())
+	if value == "" {
+		maxAge = -1
+	}
+	return &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    value,
+		Path:     "/auth/" + provider.Name(),
+		MaxAge:   maxAge,
+		Secure:   s.config.CookieSecure,
+		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
-	})
+	}
+}
+
+// handleOAuthLogin sends the user to the provider's login page
+func (s *Server) handleOAuthLogin(provider OAuthProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthConfig := provider.OAuth2Config(s.oauthCallbackURL(provider))
+		slog.DebugContext(r.Context(), "Starting login", "provider", provider.Name(), "callback", oauthConfig.RedirectURL)
+
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+		state := base64.RawURLEncoding.EncodeToString(b)
+		http.SetCookie(w, s.oauthStateCookieFor(provider, state))
 
-	// Redirect to frontend with success parameter
-	http.Redirect(w, r, "http://localhost:3000?login=success", http.StatusTemporaryRedirect)
+		// Generate the authorization URL
+		url := oauthConfig.AuthCodeURL(state)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	}
 }
 
-func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	// Handle preflight
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+// handleOAuthCallback signs the user in after the provider redirected back
+func (s *Server) handleOAuthCallback(provider OAuthProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The state is single use
+		cookie, err := r.Cookie(oauthStateCookie)
+		http.SetCookie(w, s.oauthStateCookieFor(provider, ""))
+		state := r.URL.Query().Get("state")
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			oauthLogins.WithLabelValues(provider.Name(), "failure").Inc()
+			s.audit.Record(r.Context(), "LOGIN_FAILED", "", "", provider.Name()+": state mismatch")
+			http.Error(w, "Login expired or was started elsewhere, please try again", http.StatusBadRequest)
+			return
+		}
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			http.Error(w, "Code not found", http.StatusBadRequest)
+			return
+		}
+
+		oauthConfig := provider.OAuth2Config(s.oauthCallbackURL(provider))
+		token, err := oauthConfig.Exchange(r.Context(), code)
+		if err != nil {
+			oauthLogins.WithLabelValues(provider.Name(), "failure").Inc()
+			s.audit.Record(r.Context(), "LOGIN_FAILED", "", "", provider.Name()+": "+err.Error())
+			http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
+			return
+		}
+
+		login, err := provider.Login(r.Context(), oauthConfig.Client(r.Context(), token))
+		if err != nil {
+			oauthLogins.WithLabelValues(provider.Name(), "failure").Inc()
+			s.audit.Record(r.Context(), "LOGIN_FAILED", "", "", provider.Name()+": "+err.Error())
+			http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+			return
+		}
+		oauthLogins.WithLabelValues(provider.Name(), "success").Inc()
+		s.audit.Record(r.Context(), "LOGIN", login, "", provider.Name())
+		s.resolver.userJoined(r.Context(), login)
+
+		// Sign the session with the username
+		s.sessions.Login(w, login)
+
+		slog.InfoContext(r.Context(), "Logged in", "login", login, "provider", provider.Name())
+
+		// Redirect with JavaScript to ensure cookie is properly set
+		attrs := "samesite=lax"
+		if s.config.CookieDomain != "" {
+			attrs = "domain=" + s.config.CookieDomain + ";" + attrs
+		}
+		if s.config.CookieSecure {
+			attrs = "secure;" + attrs
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = callbackPage.Execute(w, map[string]string{
+			"Nonce":    cspNonce(r.Context()),
+			"Cookie":   fmt.Sprintf("%s=%s;path=/;max-age=%d;%s", displayCookie, login, int(s.config.CookieMaxAge.Seconds()), attrs),
+			"Redirect": s.config.FrontendURL,
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to render callback page", "error", err)
+		}
 	}
+}
 
-	cookie, err := r.Cookie("user_id")
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`{"error": "Not logged in"}`))
+// handleLogout clears the session cookies. It only accepts POST from the
+// site itself or an allowed origin, so other sites can't log visitors out.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to log out", http.StatusMethodNotAllowed)
 		return
 	}
-
-	userKey := "user:" + cookie.Value
-	userData, err := s.redis.Get(r.Context(), userKey).Result()
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(`{"error": "User not found"}`))
+	if origin := r.Header.Get("Origin"); origin != "" && !s.origins.Allowed(origin) && !sameOrigin(r, origin) {
+		slog.WarnContext(r.Context(), "Rejected logout from disallowed origin", "origin", origin)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(userData))
+	if user := ClientFromContext(r.Context()).User; user != "" {
+		s.audit.Record(r.Context(), "LOGOUT", user, "", "")
+	}
+	s.sessions.Logout(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sameOrigin reports whether origin is the host the request was sent to
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == r.Host
 }
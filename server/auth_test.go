@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// fakeGitLab issues a token for the code "good-code" and says it belongs to
+// alice
+func fakeGitLab(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "gitlab-token", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gitlab-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"username": "alice"})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startLogin begins a GitLab login and returns the state sent to the
+// provider together with the state cookie
+func startLogin(t *testing.T, s *Server, gitlabURL string) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/gitlab", nil))
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), gitlabURL+"/oauth/authorize?") {
+		t.Fatalf("login redirects to %q", rec.Header().Get("Location"))
+	}
+	if got, want := location.Query().Get("redirect_uri"), s.config.BaseURL+"/auth/gitlab/callback"; got != want {
+		t.Errorf("redirect_uri %q, want %q", got, want)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oauthStateCookie || !cookies[0].HttpOnly || cookies[0].Path != "/auth/gitlab" {
+		t.Fatalf("login cookies %v, want an HttpOnly state cookie for /auth/gitlab", cookies)
+	}
+	state := location.Query().Get("state")
+	if len(state) < 32 || state != cookies[0].Value {
+		t.Fatalf("state %q, cookie %q", state, cookies[0].Value)
+	}
+	return state, cookies[0]
+}
+
+// finishLogin calls the GitLab callback and returns the response and the
+// user of the session it set, if any
+func finishLogin(s *Server, query string, cookie *http.Cookie) (*httptest.ResponseRecorder, string) {
+	req := httptest.NewRequest(http.MethodGet, "/auth/gitlab/callback?"+query, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	session := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge >= 0 {
+			session.AddCookie(cookie)
+		}
+	}
+	return rec, s.sessions.User(session)
+}
+
+func TestOAuthProviderLogin(t *testing.T) {
+	gitlab := fakeGitLab(t)
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.GitLabClientID = "gitlab-id"
+		cfg.GitLabClientSecret = "gitlab-secret"
+		cfg.GitLabURL = gitlab.URL
+	})
+
+	state, cookie := startLogin(t, s, gitlab.URL)
+	rec, user := finishLogin(s, "code=good-code&state="+state, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("callback status %d: %s", rec.Code, rec.Body)
+	}
+	// GitLab users can't pass for the GitHub user of the same name
+	if user != "alice"+gitLabSuffix {
+		t.Errorf("session user %q, want alice%s", user, gitLabSuffix)
+	}
+
+	state, cookie = startLogin(t, s, gitlab.URL)
+	if rec, user := finishLogin(s, "code=bad-code&state="+state, cookie); rec.Code != http.StatusInternalServerError || user != "" {
+		t.Errorf("bad code: status %d, user %q", rec.Code, user)
+	}
+
+	// Providers without a client ID have no routes
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/github", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/auth/github without GITHUB_CLIENT_ID: status %d, want 404", rec.Code)
+	}
+}
+
+func TestOAuthState(t *testing.T) {
+	gitlab := fakeGitLab(t)
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.GitLabClientID = "gitlab-id"
+		cfg.GitLabClientSecret = "gitlab-secret"
+		cfg.GitLabURL = gitlab.URL
+	})
+	state, cookie := startLogin(t, s, gitlab.URL)
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie *http.Cookie
+	}{
+		// A link from another site carries the attacker's code and state,
+		// but the visitor's browser has no matching cookie
+		{"no cookie", "code=good-code&state=" + state, nil},
+		{"other state", "code=good-code&state=forged", cookie},
+		{"no state", "code=good-code", cookie},
+		{"old constant state", "code=good-code&state=state", &http.Cookie{Name: oauthStateCookie, Value: "other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, user := finishLogin(s, tt.query, tt.cookie)
+			if rec.Code != http.StatusBadRequest || user != "" {
+				t.Errorf("status %d, user %q, want 400 and no session", rec.Code, user)
+			}
+		})
+	}
+
+	// The callback deletes the state so it's only used once
+	rec, _ := finishLogin(s, "code=good-code&state="+state, cookie)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	deleted := false
+	for _, c := range rec.Result().Cookies() {
+		deleted = deleted || (c.Name == oauthStateCookie && c.MaxAge < 0 && c.Path == "/auth/gitlab")
+	}
+	if !deleted {
+		t.Errorf("callback cookies %v, want the state cookie deleted", rec.Result().Cookies())
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 keeps objects in memory and checks that requests are path-style and
+// carry a SigV4 header for the configured credentials
+type fakeS3 struct {
+	t       *testing.T
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+var sigV4Authorization = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=test-key/\d{8}/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}$`)
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if !sigV4Authorization.MatchString(r.Header.Get("Authorization")) {
+		f.t.Errorf("%s %s: Authorization %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		f.t.Errorf("%s %s: payload hash doesn't match the body", r.Method, r.URL.Path)
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/chat-bucket/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestBlobStores(t *testing.T) {
+	s3 := httptest.NewServer(&fakeS3{t: t, objects: map[string][]byte{}})
+	defer s3.Close()
+
+	stores := map[string]func(t *testing.T) BlobStore{
+		"local": func(t *testing.T) BlobStore {
+			store, err := NewBlobStore(&ServerConfig{BlobStore: "local", BlobDir: t.TempDir()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		"s3": func(t *testing.T) BlobStore {
+			store, err := NewS3BlobStore(S3Config{
+				Endpoint:  s3.URL,
+				Region:    "eu-west-1",
+				Bucket:    "chat-bucket",
+				AccessKey: "test-key",
+				SecretKey: "test-secret",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			key := attachmentBlobKey("2abc", "original")
+
+			if _, err := store.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+				t.Errorf("Get before Put: %v, want ErrBlobNotFound", err)
+			}
+			if err := store.Put(ctx, key, []byte("first"), "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Put(ctx, key, []byte("second"), "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+
+			blob, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(blob)
+			blob.Close()
+			if err != nil || string(data) != "second" {
+				t.Errorf("Get = %q, %v, want the last Put", data, err)
+			}
+
+			if err := store.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+				t.Errorf("Get after Delete: %v, want ErrBlobNotFound", err)
+			}
+			// Deleting twice isn't an error, cleanup may run more than once
+			if err := store.Delete(ctx, key); err != nil {
+				t.Errorf("second Delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalBlobStoreKeys(t *testing.T) {
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "/", "../outside", "attachments/../../outside"} {
+		if err := store.Put(context.Background(), key, []byte("x"), "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+func blocksKey(user string) string {
+	return "blocks:" + user
+}
+
+// blockedUsers returns the logins a user has blocked
+func (r *Resolver) blockedUsers(ctx context.Context, user string) ([]string, error) {
+	if user == "" {
+		return nil, nil
+	}
+	return r.redis.SMembers(ctx, blocksKey(user)).Result()
+}
+
+func (r *Resolver) blockUser(ctx context.Context, user string, target string) error {
+	if target == user {
+		return errors.New("you can't block yourself")
+	}
+	if err := r.redis.SAdd(ctx, blocksKey(user), target).Err(); err != nil {
+		return err
+	}
+	r.setBlocked(user, target, true)
+	return nil
+}
+
+func (r *Resolver) unblockUser(ctx context.Context, user string, target string) error {
+	if err := r.redis.SRem(ctx, blocksKey(user), target).Err(); err != nil {
+		return err
+	}
+	r.setBlocked(user, target, false)
+	return nil
+}
+
+// setBlocked updates the in-memory block list used by live subscriptions
+func (r *Resolver) setBlocked(user string, target string, blocked bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if list, ok := r.blocked[user]; ok {
+		if blocked {
+			list[target] = true
+		} else {
+			delete(list, target)
+		}
+	}
+}
+
+// filterBlocked removes messages by authors the user has blocked
+func (r *Resolver) filterBlocked(ctx context.Context, user string, messages []*Message) ([]*Message, error) {
+	blocked, err := r.blockedUsers(ctx, user)
+	if err != nil || len(blocked) == 0 {
+		return messages, err
+	}
+
+	set := make(map[string]bool, len(blocked))
+	for _, b := range blocked {
+		set[b] = true
+	}
+
+	filtered := messages[:0]
+	for _, message := range messages {
+		if !set[message.User] {
+			filtered = append(filtered, message)
+		}
+	}
+	return filtered, nil
+}
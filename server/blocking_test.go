@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const blockUserMutation = `mutation($user: String!) { blockUser(user: $user) }`
+
+// messageAuthors returns the authors of the latest messages as seen by user
+func messageAuthors(t *testing.T, s *Server, user string) []string {
+	t.Helper()
+	result := doGraphQL(t, s, `{ messages { user } }`, nil, sessionFor(s, user))
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	var data struct {
+		Messages []struct{ User string }
+	}
+	if err := json.Unmarshal(result.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	authors := []string{}
+	for _, msg := range data.Messages {
+		authors = append(authors, msg.User)
+	}
+	return authors
+}
+
+// nextAuthor returns the author of the next message on ch
+func nextAuthor(t *testing.T, ch <-chan *Message) string {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg.User
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+		return ""
+	}
+}
+
+func asUser(user string) context.Context {
+	return context.WithValue(context.Background(), clientContextKey, &ClientInfo{User: user})
+}
+
+func TestBlockedUsersMessages(t *testing.T) {
+	s, mr := newTestServer(t, nil)
+	postTestMessage(t, s, "bob", "a message from bob")
+	postTestMessage(t, s, "carol", "a message from carol")
+
+	if result := doGraphQL(t, s, blockUserMutation, map[string]interface{}{"user": "bob"}, sessionFor(s, "alice")); len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if authors := messageAuthors(t, s, "alice"); len(authors) != 1 || authors[0] != "carol" {
+		t.Errorf("alice sees messages by %v, want only carol", authors)
+	}
+	// Blocking is one-sided
+	if authors := messageAuthors(t, s, "bob"); len(authors) != 2 {
+		t.Errorf("bob sees messages by %v, want bob and carol", authors)
+	}
+
+	// The block list is kept in Redis, so another instance applies it too
+	if members, _ := mr.Members(blocksKey("alice")); len(members) != 1 || members[0] != "bob" {
+		t.Errorf("blocks in Redis: %v", members)
+	}
+	other, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.RedisURL = "redis://" + mr.Addr()
+	})
+	if authors := messageAuthors(t, other, "alice"); len(authors) != 1 || authors[0] != "carol" {
+		t.Errorf("alice sees messages by %v on another instance, want only carol", authors)
+	}
+
+	if result := doGraphQL(t, s, `mutation { unblockUser(user: "bob") }`, nil, sessionFor(s, "alice")); len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if authors := messageAuthors(t, s, "alice"); len(authors) != 2 {
+		t.Errorf("alice sees messages by %v after unblocking, want bob and carol", authors)
+	}
+}
+
+func TestBlockedUsersLive(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	subscriptions := &subscriptionResolver{s.resolver}
+	ctx, cancel := context.WithCancel(asUser("alice"))
+	defer cancel()
+
+	live, err := subscriptions.MessagePosted(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocking applies to subscriptions that are already open
+	if result := doGraphQL(t, s, blockUserMutation, map[string]interface{}{"user": "bob"}, sessionFor(s, "alice")); len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	postTestMessage(t, s, "bob", "a message from bob")
+	postTestMessage(t, s, "carol", "a message from carol")
+	if author := nextAuthor(t, live); author != "carol" {
+		t.Errorf("alice was sent a message by %s, want carol", author)
+	}
+
+	// So does the block list stored before subscribing
+	cancel()
+	ctx, cancel = context.WithCancel(asUser("alice"))
+	defer cancel()
+	if live, err = subscriptions.MessagePosted(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	postTestMessage(t, s, "bob", "another message from bob")
+	postTestMessage(t, s, "carol", "another message from carol")
+	if author := nextAuthor(t, live); author != "carol" {
+		t.Errorf("alice's new subscription was sent a message by %s, want carol", author)
+	}
+
+	// Anonymous subscribers can't borrow alice's block list by naming her
+	anonymous, err := subscriptions.MessagePosted(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postTestMessage(t, s, "bob", "a third message from bob")
+	if author := nextAuthor(t, anonymous); author != "bob" {
+		t.Errorf("anonymous subscriber was sent a message by %s, want bob", author)
+	}
+}
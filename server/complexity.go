@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/99designs/gqlgen/complexity"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/errcode"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	// defaultListSize is the assumed length of lists without a first argument
+	defaultListSize = 100
+	// maxListSize caps the multiplier of a first argument
+	maxListSize = 1000
+)
+
+// QueryLimitConfig configures the QueryLimits extension
+type QueryLimitConfig struct {
+	MaxDepth      int
+	MaxComplexity int
+}
+
+// listMultiplier returns how many items a list field with the given first argument may return
+func listMultiplier(first *int) int {
+	if first == nil || *first <= 0 {
+		return defaultListSize
+	}
+	return min(*first, maxListSize)
+}
+
+// newComplexityRoot scores list fields by their expected length so nested
+// lists can't be used to blow up the response size
+func newComplexityRoot() ComplexityRoot {
+	var c ComplexityRoot
+
+	c.Query.Messages = func(childComplexity int, first *int) int {
+		return 1 + listMultiplier(first)*childComplexity
+	}
+	c.Query.Users = func(childComplexity int) int {
+		return 1 + defaultListSize*childComplexity
+	}
+	c.Query.BlockedUsers = func(childComplexity int) int {
+		return 1 + defaultListSize*childComplexity
+	}
+	c.Query.ModerationQueue = func(childComplexity int) int {
+		return 1 + defaultListSize*childComplexity
+	}
+	c.Query.Reports = func(childComplexity int, status ReportStatus) int {
+		return 1 + defaultListSize*childComplexity
+	}
+	c.Query.ModerationLog = func(childComplexity int, first int) int {
+		return 1 + listMultiplier(&first)*childComplexity
+	}
+	c.Query.AuditLog = func(childComplexity int, filter *AuditLogFilter, first int, after *string) int {
+		return 1 + listMultiplier(&first)*childComplexity
+	}
+	c.Query.AccessTokens = func(childComplexity int, user *string) int {
+		return 1 + maxAccessTokensPerUser*childComplexity
+	}
+	c.Query.Bots = func(childComplexity int) int {
+		return 1 + defaultListSize*childComplexity
+	}
+	c.Query.Webhooks = func(childComplexity int) int {
+		return 1 + maxWebhooks*childComplexity
+	}
+	c.Query.WebhookDeliveries = func(childComplexity int, id string, first int) int {
+		return 1 + min(listMultiplier(&first), maxWebhookDeliveries)*childComplexity
+	}
+	c.Message.Attachments = func(childComplexity int) int {
+		return maxAttachmentsPerMessage * childComplexity
+	}
+	c.Message.LinkPreviews = func(childComplexity int) int {
+		return maxPreviewsPerMessage * childComplexity
+	}
+
+	return c
+}
+
+// QueryLimits is a gqlgen extension that rejects operations that are nested
+// too deeply or are too expensive, and logs the cost of every operation
+type QueryLimits struct {
+	config QueryLimitConfig
+	es     graphql.ExecutableSchema
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+} = &QueryLimits{}
+
+func NewQueryLimits(config QueryLimitConfig) *QueryLimits {
+	return &QueryLimits{config: config}
+}
+
+func (q *QueryLimits) ExtensionName() string {
+	return "QueryLimits"
+}
+
+func (q *QueryLimits) Validate(schema graphql.ExecutableSchema) error {
+	q.es = schema
+	return nil
+}
+
+func (q *QueryLimits) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	if rc.Operation == nil {
+		return nil
+	}
+
+	depth := selectionDepth(rc.Operation.SelectionSet)
+	cost := complexity.Calculate(q.es, rc.Operation, rc.Variables)
+
+	name := rc.OperationName
+	if name == "" {
+		name = "(anonymous)"
+	}
+	slog.DebugContext(ctx, "Operation cost", "type", rc.Operation.Operation, "operation", name, "complexity", cost, "depth", depth)
+
+	if q.config.MaxDepth > 0 && depth > q.config.MaxDepth {
+		err := gqlerror.Errorf("operation has depth %d, which exceeds the limit of %d", depth, q.config.MaxDepth)
+		errcode.Set(err, "DEPTH_LIMIT_EXCEEDED")
+		return err
+	}
+	if q.config.MaxComplexity > 0 && cost > q.config.MaxComplexity {
+		err := gqlerror.Errorf("operation has complexity %d, which exceeds the limit of %d", cost, q.config.MaxComplexity)
+		errcode.Set(err, "COMPLEXITY_LIMIT_EXCEEDED")
+		return err
+	}
+	return nil
+}
+
+// selectionDepth returns the deepest level of nested fields, following
+// fragments and ignoring introspection
+func selectionDepth(selections ast.SelectionSet) int {
+	depth := 0
+	for _, selection := range selections {
+		var d int
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name, "__") {
+				continue
+			}
+			d = 1 + selectionDepth(s.SelectionSet)
+		case *ast.InlineFragment:
+			d = selectionDepth(s.SelectionSet)
+		case *ast.FragmentSpread:
+			if s.Definition != nil {
+				d = selectionDepth(s.Definition.SelectionSet)
+			}
+		}
+		depth = max(depth, d)
+	}
+	return depth
+}
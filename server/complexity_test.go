@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestListFieldComplexity(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.MaxComplexity = 50
+	})
+
+	queries := map[string]string{
+		"reports":           `{ reports { id reason status } }`,
+		"moderationQueue":   `{ moderationQueue { id user text } }`,
+		"moderationLog":     `{ moderationLog(first: 1000) { id action actor } }`,
+		"auditLog":          `{ auditLog(first: 1000) { entries { id action actor } } }`,
+		"accessTokens":      `{ accessTokens { id name scopes } }`,
+		"webhookDeliveries": `{ webhookDeliveries(id: "1") { id event success } }`,
+		"messages":          `{ messages(first: 100000000) { id user text } }`,
+	}
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			result := doGraphQL(t, s, query, nil)
+			if code := result.errorCode(); code != "COMPLEXITY_LIMIT_EXCEEDED" {
+				t.Errorf("error code %q, want COMPLEXITY_LIMIT_EXCEEDED", code)
+			}
+		})
+	}
+}
+
+func TestMessagesFirstIsClamped(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	ctx := context.Background()
+
+	pipe := s.redis.Pipeline()
+	for i := 0; i < maxListSize+10; i++ {
+		id := fmt.Sprintf("%05d", i)
+		msg, _ := json.Marshal(&Message{ID: id, User: "alice", Text: id})
+		pipe.Set(ctx, "message:"+id, msg, 0)
+		pipe.ZAdd(ctx, "messages", &redis.Z{Score: float64(i), Member: id})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{`{ messages(first: 100000000) { id } }`, maxListSize},
+		{`{ messages(first: 5) { id } }`, 5},
+		{`{ messages { id } }`, defaultListSize},
+	}
+	for _, tt := range tests {
+		result := doGraphQL(t, s, tt.query, nil)
+		if len(result.Errors) > 0 {
+			t.Fatalf("%s: %+v", tt.query, result.Errors)
+		}
+		var data struct{ Messages []Message }
+		if err := json.Unmarshal(result.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if len(data.Messages) != tt.count {
+			t.Errorf("%s returned %d messages, want %d", tt.query, len(data.Messages), tt.count)
+		}
+		if last := data.Messages[len(data.Messages)-1].ID; last != fmt.Sprintf("%05d", maxListSize+9) {
+			t.Errorf("%s: last message %s, want the latest", tt.query, last)
+		}
+	}
+}
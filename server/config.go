@@ -0,0 +1,451 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// ServerConfig holds every setting of the server. Values are read from an
+// optional YAML or TOML file first, environment variables override the file.
+type ServerConfig struct {
+	// HTTP
+	ListenAddr      string        `envconfig:"LISTEN_ADDR" yaml:"listen_addr" toml:"listen_addr"`
+	BaseURL         string        `envconfig:"BASE_URL" yaml:"base_url" toml:"base_url"`
+	FrontendURL     string        `envconfig:"FRONTEND_URL" yaml:"frontend_url" toml:"frontend_url"`
+	AllowedOrigins  []string      `envconfig:"ALLOWED_ORIGINS" yaml:"allowed_origins" toml:"allowed_origins"`
+	StaticDir       string        `envconfig:"STATIC_DIR" yaml:"static_dir" toml:"static_dir"`
+	Playground      bool          `envconfig:"PLAYGROUND" yaml:"playground" toml:"playground"`
+	TrustProxy      bool          `envconfig:"TRUST_PROXY" yaml:"trust_proxy" toml:"trust_proxy"`
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// TLS, off when running behind a proxy that terminates it
+	TLSMode          string        `envconfig:"TLS_MODE" yaml:"tls_mode" toml:"tls_mode"`
+	TLSCertFile      string        `envconfig:"TLS_CERT_FILE" yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile       string        `envconfig:"TLS_KEY_FILE" yaml:"tls_key_file" toml:"tls_key_file"`
+	ACMEDomains      []string      `envconfig:"ACME_DOMAINS" yaml:"acme_domains" toml:"acme_domains"`
+	ACMEEmail        string        `envconfig:"ACME_EMAIL" yaml:"acme_email" toml:"acme_email"`
+	ACMECacheDir     string        `envconfig:"ACME_CACHE_DIR" yaml:"acme_cache_dir" toml:"acme_cache_dir"`
+	ACMEDirectoryURL string        `envconfig:"ACME_DIRECTORY_URL" yaml:"acme_directory_url" toml:"acme_directory_url"`
+	ACMECAFile       string        `envconfig:"ACME_CA_FILE" yaml:"acme_ca_file" toml:"acme_ca_file"`
+	HTTPRedirectAddr string        `envconfig:"HTTP_REDIRECT_ADDR" yaml:"http_redirect_addr" toml:"http_redirect_addr"`
+	HSTSMaxAge       time.Duration `envconfig:"HSTS_MAX_AGE" yaml:"hsts_max_age" toml:"hsts_max_age"`
+
+	// Browser security headers, empty values disable a header. {nonce} in
+	// the CSP is replaced with a new nonce for every response.
+	ContentSecurityPolicy string `envconfig:"CONTENT_SECURITY_POLICY" yaml:"content_security_policy" toml:"content_security_policy"`
+	FrameOptions          string `envconfig:"FRAME_OPTIONS" yaml:"frame_options" toml:"frame_options"`
+	ReferrerPolicy        string `envconfig:"REFERRER_POLICY" yaml:"referrer_policy" toml:"referrer_policy"`
+	PermissionsPolicy     string `envconfig:"PERMISSIONS_POLICY" yaml:"permissions_policy" toml:"permissions_policy"`
+
+	// Session cookie, signed with SessionSecret
+	SessionSecret string        `envconfig:"SESSION_SECRET" yaml:"session_secret" toml:"session_secret"`
+	CookieDomain  string        `envconfig:"COOKIE_DOMAIN" yaml:"cookie_domain" toml:"cookie_domain"`
+	CookieSecure  bool          `envconfig:"COOKIE_SECURE" yaml:"cookie_secure" toml:"cookie_secure"`
+	CookieMaxAge  time.Duration `envconfig:"COOKIE_MAX_AGE" yaml:"cookie_max_age" toml:"cookie_max_age"`
+
+	// OAuth login providers, each one is enabled by setting its client ID.
+	// GITLAB_URL points to a self-hosted GitLab.
+	GitHubClientID     string   `envconfig:"GITHUB_CLIENT_ID" yaml:"github_client_id" toml:"github_client_id"`
+	GitHubClientSecret string   `envconfig:"GITHUB_CLIENT_SECRET" yaml:"github_client_secret" toml:"github_client_secret"`
+	GitLabClientID     string   `envconfig:"GITLAB_CLIENT_ID" yaml:"gitlab_client_id" toml:"gitlab_client_id"`
+	GitLabClientSecret string   `envconfig:"GITLAB_CLIENT_SECRET" yaml:"gitlab_client_secret" toml:"gitlab_client_secret"`
+	GitLabURL          string   `envconfig:"GITLAB_URL" yaml:"gitlab_url" toml:"gitlab_url"`
+	OwnerUsers         []string `envconfig:"OWNER_USERS" yaml:"owner_users" toml:"owner_users"`
+
+	RedisURL string `envconfig:"REDIS_URL" yaml:"redis_url" toml:"redis_url"`
+
+	// Attachments
+	BlobStore   string `envconfig:"BLOB_STORE" yaml:"blob_store" toml:"blob_store"`
+	BlobDir     string `envconfig:"BLOB_DIR" yaml:"blob_dir" toml:"blob_dir"`
+	S3Endpoint  string `envconfig:"S3_ENDPOINT" yaml:"s3_endpoint" toml:"s3_endpoint"`
+	S3Region    string `envconfig:"S3_REGION" yaml:"s3_region" toml:"s3_region"`
+	S3Bucket    string `envconfig:"S3_BUCKET" yaml:"s3_bucket" toml:"s3_bucket"`
+	S3AccessKey string `envconfig:"S3_ACCESS_KEY" yaml:"s3_access_key" toml:"s3_access_key"`
+	S3SecretKey string `envconfig:"S3_SECRET_KEY" yaml:"s3_secret_key" toml:"s3_secret_key"`
+
+	// GraphQL
+	PersistedQueriesOnly     bool   `envconfig:"PERSISTED_QUERIES_ONLY" yaml:"persisted_queries_only" toml:"persisted_queries_only"`
+	PersistedQueriesManifest string `envconfig:"PERSISTED_QUERIES_MANIFEST" yaml:"persisted_queries_manifest" toml:"persisted_queries_manifest"`
+	APQCache                 string `envconfig:"APQ_CACHE" yaml:"apq_cache" toml:"apq_cache"`
+	MaxDepth                 int    `envconfig:"GRAPHQL_MAX_DEPTH" yaml:"graphql_max_depth" toml:"graphql_max_depth"`
+	MaxComplexity            int    `envconfig:"GRAPHQL_MAX_COMPLEXITY" yaml:"graphql_max_complexity" toml:"graphql_max_complexity"`
+	RateLimitBackend         string `envconfig:"RATE_LIMIT_BACKEND" yaml:"rate_limit_backend" toml:"rate_limit_backend"`
+	RateLimits               string `envconfig:"RATE_LIMITS" yaml:"rate_limits" toml:"rate_limits"`
+	MaxSubscriptionsPerUser  int    `envconfig:"MAX_SUBSCRIPTIONS_PER_USER" yaml:"max_subscriptions_per_user" toml:"max_subscriptions_per_user"`
+
+	// Moderation
+	ModerationMaxLength       int           `envconfig:"MODERATION_MAX_LENGTH" yaml:"moderation_max_length" toml:"moderation_max_length"`
+	ModerationMaxLinks        int           `envconfig:"MODERATION_MAX_LINKS" yaml:"moderation_max_links" toml:"moderation_max_links"`
+	ModerationRepeatWindow    time.Duration `envconfig:"MODERATION_REPEAT_WINDOW" yaml:"moderation_repeat_window" toml:"moderation_repeat_window"`
+	ModerationWordlist        string        `envconfig:"MODERATION_WORDLIST" yaml:"moderation_wordlist" toml:"moderation_wordlist"`
+	ModerationWordlistAction  string        `envconfig:"MODERATION_WORDLIST_ACTION" yaml:"moderation_wordlist_action" toml:"moderation_wordlist_action"`
+	ModerationBlocklist       string        `envconfig:"MODERATION_BLOCKLIST" yaml:"moderation_blocklist" toml:"moderation_blocklist"`
+	ModerationBlocklistAction string        `envconfig:"MODERATION_BLOCKLIST_ACTION" yaml:"moderation_blocklist_action" toml:"moderation_blocklist_action"`
+	ReportHideThreshold       int           `envconfig:"REPORT_HIDE_THRESHOLD" yaml:"report_hide_threshold" toml:"report_hide_threshold"`
+
+	// Webhooks may only reach public addresses unless this is set
+	WebhookAllowPrivate bool `envconfig:"WEBHOOK_ALLOW_PRIVATE" yaml:"webhook_allow_private" toml:"webhook_allow_private"`
+
+	// Operations. Metrics are served on their own listener so they aren't
+	// public, an empty METRICS_ADDR turns them off.
+	MetricsAddr        string        `envconfig:"METRICS_ADDR" yaml:"metrics_addr" toml:"metrics_addr"`
+	AuditLogFile       string        `envconfig:"AUDIT_LOG_FILE" yaml:"audit_log_file" toml:"audit_log_file"`
+	HealthCheckTimeout time.Duration `envconfig:"HEALTH_CHECK_TIMEOUT" yaml:"health_check_timeout" toml:"health_check_timeout"`
+	LogLevel           string        `envconfig:"LOG_LEVEL" yaml:"log_level" toml:"log_level"`
+	LogFormat          string        `envconfig:"LOG_FORMAT" yaml:"log_format" toml:"log_format"`
+	LogMessageBodies   bool          `envconfig:"LOG_MESSAGE_BODIES" yaml:"log_message_bodies" toml:"log_message_bodies"`
+	TracesExporter     string        `envconfig:"OTEL_TRACES_EXPORTER" yaml:"traces_exporter" toml:"traces_exporter"`
+	ServiceName        string        `envconfig:"OTEL_SERVICE_NAME" yaml:"service_name" toml:"service_name"`
+}
+
+// defaultStaticDir is where the frontend is read from when it isn't embedded
+const defaultStaticDir = "./static"
+
+// DefaultConfig returns the settings for local development
+func DefaultConfig() ServerConfig {
+	return ServerConfig{
+		ListenAddr:      ":8080",
+		BaseURL:         "http://localhost:8080",
+		FrontendURL:     "http://localhost:3000",
+		Playground:      true,
+		ShutdownTimeout: 25 * time.Second,
+
+		TLSMode:      "off",
+		ACMECacheDir: "./data/acme",
+		HSTSMaxAge:   180 * 24 * time.Hour,
+
+		ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; " +
+			"img-src 'self' data: https:; connect-src 'self'; object-src 'none'; base-uri 'self'; " +
+			"form-action 'self'; frame-ancestors 'none'",
+		FrameOptions:      "DENY",
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+
+		CookieMaxAge: 24 * time.Hour,
+
+		GitLabURL: "https://gitlab.com",
+
+		RedisURL: "redis://localhost:6379",
+
+		BlobStore: "local",
+		BlobDir:   "./data/blobs",
+
+		APQCache:                "memory",
+		MaxDepth:                10,
+		MaxComplexity:           10000,
+		RateLimitBackend:        "memory",
+		MaxSubscriptionsPerUser: 10,
+
+		ModerationMaxLength:       2000,
+		ModerationMaxLinks:        5,
+		ModerationRepeatWindow:    time.Minute,
+		ModerationWordlistAction:  "mask",
+		ModerationBlocklistAction: "reject",
+		ReportHideThreshold:       defaultReportHideThreshold,
+
+		MetricsAddr:        ":9091",
+		HealthCheckTimeout: defaultHealthCheckTimeout,
+		LogLevel:           "info",
+		LogFormat:          "text",
+		TracesExporter:     "none",
+		ServiceName:        "graphql-realtime-chat",
+	}
+}
+
+// LoadConfig reads the defaults, then the config file at path if it isn't
+// empty, then the environment. Running with NODE_ENV=production turns the
+// development conveniences off unless they are set explicitly.
+func LoadConfig(path string) (ServerConfig, error) {
+	cfg := DefaultConfig()
+	if os.Getenv("NODE_ENV") == "production" {
+		cfg.Playground = false
+		cfg.BaseURL = ""
+		cfg.FrontendURL = ""
+		cfg.CookieSecure = true
+		cfg.LogFormat = "json"
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.ListenAddr = ":" + port
+	}
+	// fly.io's edge sets Fly-Client-IP
+	if os.Getenv("FLY_APP_NAME") != "" {
+		cfg.TrustProxy = true
+	}
+
+	if path != "" {
+		if err := decodeConfigFile(path, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	// Only variables that are set override the file
+	if err := envconfig.Process("", &cfg); err != nil {
+		return cfg, err
+	}
+
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	cfg.FrontendURL = strings.TrimSuffix(cfg.FrontendURL, "/")
+	if cfg.FrontendURL == "" {
+		cfg.FrontendURL = cfg.BaseURL
+	}
+	if len(cfg.AllowedOrigins) == 0 && cfg.BaseURL != "" {
+		cfg.AllowedOrigins = []string{cfg.BaseURL}
+		if cfg.FrontendURL != cfg.BaseURL {
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, cfg.FrontendURL)
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// decodeConfigFile reads a .toml file as TOML and anything else as YAML.
+// Unknown keys are errors in both, so typos don't go unnoticed.
+func decodeConfigFile(path string, cfg *ServerConfig) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		meta, err := toml.NewDecoder(f).Decode(cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown setting %q", undecoded[0].String())
+		}
+		return nil
+	}
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *ServerConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.ListenAddr != "", "LISTEN_ADDR is required")
+	check(c.BaseURL != "", "BASE_URL is required")
+	for _, setting := range [][2]string{{"BASE_URL", c.BaseURL}, {"FRONTEND_URL", c.FrontendURL}} {
+		if setting[1] == "" {
+			continue
+		}
+		u, err := url.Parse(setting[1])
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"%s must be an absolute http(s) URL, got %q", setting[0], setting[1])
+	}
+	_, err := NewOriginPolicy(c.AllowedOrigins)
+	check(err == nil, "ALLOWED_ORIGINS: %v", err)
+	check(c.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive")
+	// A random secret logs everyone out on every deploy and isn't shared
+	// between instances, so it's only good enough for development
+	if os.Getenv("NODE_ENV") == "production" {
+		check(c.SessionSecret != "", "SESSION_SECRET is required in production")
+	}
+	check(c.SessionSecret == "" || len(c.SessionSecret) >= minSessionSecretLength,
+		"SESSION_SECRET must be at least %d characters", minSessionSecretLength)
+	check(c.CookieMaxAge > 0, "COOKIE_MAX_AGE must be positive")
+	check((c.GitHubClientID == "") == (c.GitHubClientSecret == ""), "GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET must be set together")
+	check((c.GitLabClientID == "") == (c.GitLabClientSecret == ""), "GITLAB_CLIENT_ID and GITLAB_CLIENT_SECRET must be set together")
+	if c.GitLabClientID != "" {
+		u, err := url.Parse(c.GitLabURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"GITLAB_URL must be an absolute http(s) URL, got %q", c.GitLabURL)
+	}
+	check(c.FrameOptions == "" || slices.Contains([]string{"DENY", "SAMEORIGIN"}, strings.ToUpper(c.FrameOptions)),
+		"FRAME_OPTIONS must be DENY, SAMEORIGIN or empty, got %q", c.FrameOptions)
+	for _, setting := range [][2]string{
+		{"CONTENT_SECURITY_POLICY", c.ContentSecurityPolicy},
+		{"REFERRER_POLICY", c.ReferrerPolicy},
+		{"PERMISSIONS_POLICY", c.PermissionsPolicy},
+	} {
+		check(!strings.ContainsAny(setting[1], "\r\n"), "%s must be a single line", setting[0])
+	}
+
+	check(slices.Contains([]string{"off", "files", "acme"}, c.TLSMode), "TLS_MODE must be off, files or acme, got %q", c.TLSMode)
+	switch c.TLSMode {
+	case "off":
+		check(c.HTTPRedirectAddr == "", "HTTP_REDIRECT_ADDR requires TLS_MODE files or acme")
+	case "files":
+		check(c.TLSCertFile != "" && c.TLSKeyFile != "", "TLS_CERT_FILE and TLS_KEY_FILE are required for TLS_MODE=files")
+	case "acme":
+		check(len(c.ACMEDomains) > 0, "ACME_DOMAINS is required for TLS_MODE=acme")
+		check(c.ACMECacheDir != "", "ACME_CACHE_DIR is required for TLS_MODE=acme")
+	}
+	check(c.HSTSMaxAge >= 0, "HSTS_MAX_AGE must not be negative")
+	check(c.RedisURL != "", "REDIS_URL is required")
+
+	check(slices.Contains([]string{"local", "s3"}, c.BlobStore), "BLOB_STORE must be local or s3, got %q", c.BlobStore)
+	if c.BlobStore == "s3" {
+		check(c.S3Endpoint != "" && c.S3Bucket != "", "S3_ENDPOINT and S3_BUCKET are required for the s3 blob store")
+	}
+
+	if c.PersistedQueriesOnly {
+		check(c.PersistedQueriesManifest != "", "PERSISTED_QUERIES_MANIFEST is required with PERSISTED_QUERIES_ONLY")
+	}
+	check(slices.Contains([]string{"memory", "redis"}, c.APQCache), "APQ_CACHE must be memory or redis, got %q", c.APQCache)
+	check(slices.Contains([]string{"memory", "redis"}, c.RateLimitBackend), "RATE_LIMIT_BACKEND must be memory or redis, got %q", c.RateLimitBackend)
+	check(c.MaxDepth > 0, "GRAPHQL_MAX_DEPTH must be positive")
+	check(c.MaxComplexity > 0, "GRAPHQL_MAX_COMPLEXITY must be positive")
+	if _, err := c.RateLimitConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, setting := range [][2]string{
+		{"MODERATION_WORDLIST_ACTION", c.ModerationWordlistAction},
+		{"MODERATION_BLOCKLIST_ACTION", c.ModerationBlocklistAction},
+	} {
+		_, err := parseModerationAction(setting[1], ActionAllow)
+		check(err == nil, "%s: %v", setting[0], err)
+	}
+	check(c.ReportHideThreshold > 0, "REPORT_HIDE_THRESHOLD must be positive")
+
+	check(c.MetricsAddr == "" || c.MetricsAddr != c.ListenAddr, "METRICS_ADDR must not be LISTEN_ADDR, metrics aren't public")
+	check(c.HealthCheckTimeout > 0, "HEALTH_CHECK_TIMEOUT must be positive")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "LOG_LEVEL must be debug, info, warn or error, got %q", c.LogLevel)
+	check(slices.Contains([]string{"text", "json"}, c.LogFormat), "LOG_FORMAT must be text or json, got %q", c.LogFormat)
+	check(slices.Contains([]string{"none", "otlp", "stdout"}, c.TracesExporter), "OTEL_TRACES_EXPORTER must be none, otlp or stdout, got %q", c.TracesExporter)
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy that is safe to print
+func (c ServerConfig) Redacted() ServerConfig {
+	for _, secret := range []*string{&c.SessionSecret, &c.GitHubClientSecret, &c.GitLabClientSecret, &c.S3SecretKey} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	c.RedisURL = redactURL(c.RedisURL)
+	return c
+}
+
+// WriteYAML prints the configuration in the format of the config file
+func (c ServerConfig) WriteYAML(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(c)
+}
+
+// QueryLimitConfig returns the settings of the QueryLimits extension
+func (c *ServerConfig) QueryLimitConfig() QueryLimitConfig {
+	return QueryLimitConfig{MaxDepth: c.MaxDepth, MaxComplexity: c.MaxComplexity}
+}
+
+// RateLimitConfig parses RATE_LIMITS ("postMessage=30/m,*=120/m", where "*"
+// is the default for mutations) on top of the default limits
+func (c *ServerConfig) RateLimitConfig() (RateLimitConfig, error) {
+	cfg := DefaultRateLimitConfig()
+	cfg.MaxSubscriptionsPerUser = c.MaxSubscriptionsPerUser
+
+	if c.RateLimits == "" {
+		return cfg, nil
+	}
+	for _, entry := range strings.Split(c.RateLimits, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid rate limit %q", entry)
+		}
+		limit, err := parseLimit(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid rate limit %q: %w", entry, err)
+		}
+		if name == "*" {
+			cfg.DefaultMutation = limit
+		} else {
+			cfg.Fields[name] = limit
+		}
+	}
+	return cfg, nil
+}
+
+// ModerationConfig loads the wordlist and blocklist files, which contain one
+// word or pattern per line
+func (c *ServerConfig) ModerationConfig() (ModerationConfig, error) {
+	cfg := ModerationConfig{
+		MaxLength:    c.ModerationMaxLength,
+		MaxLinks:     c.ModerationMaxLinks,
+		RepeatWindow: c.ModerationRepeatWindow,
+	}
+
+	var err error
+	if cfg.WordlistAction, err = parseModerationAction(c.ModerationWordlistAction, ActionMask); err != nil {
+		return cfg, err
+	}
+	if cfg.BlocklistAction, err = parseModerationAction(c.ModerationBlocklistAction, ActionReject); err != nil {
+		return cfg, err
+	}
+
+	if c.ModerationWordlist != "" {
+		if cfg.Wordlist, err = readLines(c.ModerationWordlist); err != nil {
+			return cfg, err
+		}
+	}
+	if c.ModerationBlocklist != "" {
+		patterns, err := readLines(c.ModerationBlocklist)
+		if err != nil {
+			return cfg, err
+		}
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid blocklist pattern %q: %w", pattern, err)
+			}
+			cfg.Blocklist = append(cfg.Blocklist, re)
+		}
+	}
+
+	return cfg, nil
+}
+
+// OAuthProviders returns the login providers that have a client ID
+func (c *ServerConfig) OAuthProviders() []OAuthProvider {
+	var providers []OAuthProvider
+	if c.GitHubClientID != "" {
+		providers = append(providers, &gitHubProvider{clientID: c.GitHubClientID, clientSecret: c.GitHubClientSecret})
+	}
+	if c.GitLabClientID != "" {
+		providers = append(providers, &gitLabProvider{
+			clientID:     c.GitLabClientID,
+			clientSecret: c.GitLabClientSecret,
+			baseURL:      strings.TrimSuffix(c.GitLabURL, "/"),
+		})
+	}
+	return providers
+}
+
+// S3Config returns the settings of the s3 blob store
+func (c *ServerConfig) S3Config() S3Config {
+	return S3Config{
+		Endpoint:  c.S3Endpoint,
+		Region:    c.S3Region,
+		Bucket:    c.S3Bucket,
+		AccessKey: c.S3AccessKey,
+		SecretKey: c.S3SecretKey,
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+base_url: https://chat.example.com/
+allowed_origins: [https://chat.example.com, https://app.example.com]
+cookie_max_age: 12h
+graphql_max_depth: 7
+gitlab_client_id: gitlab-id
+gitlab_client_secret: gitlab-secret
+`,
+		"config.toml": `
+base_url = "https://chat.example.com/"
+allowed_origins = ["https://chat.example.com", "https://app.example.com"]
+cookie_max_age = "12h"
+graphql_max_depth = 7
+gitlab_client_id = "gitlab-id"
+gitlab_client_secret = "gitlab-secret"
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("GRAPHQL_MAX_DEPTH", "9")
+			cfg, err := LoadConfig(writeConfigFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.BaseURL != "https://chat.example.com" || cfg.CookieMaxAge != 12*time.Hour || cfg.GitLabClientID != "gitlab-id" {
+				t.Errorf("decoded %q, %v, %q", cfg.BaseURL, cfg.CookieMaxAge, cfg.GitLabClientID)
+			}
+			if want := []string{"https://chat.example.com", "https://app.example.com"}; !reflect.DeepEqual(cfg.AllowedOrigins, want) {
+				t.Errorf("AllowedOrigins = %v, want %v", cfg.AllowedOrigins, want)
+			}
+			// The environment overrides the file
+			if cfg.MaxDepth != 9 {
+				t.Errorf("MaxDepth = %d, want 9 from GRAPHQL_MAX_DEPTH", cfg.MaxDepth)
+			}
+
+			providers := cfg.OAuthProviders()
+			if len(providers) != 1 || providers[0].Name() != "gitlab" {
+				t.Errorf("providers %v, want only gitlab", providers)
+			}
+			if cfg.Redacted().GitLabClientSecret != redacted {
+				t.Error("GITLAB_CLIENT_SECRET isn't redacted")
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsUnknownSettings(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": "base_url: https://chat.example.com\nbase_ulr: typo\n",
+		"config.toml": "base_url = \"https://chat.example.com\"\nbase_ulr = \"typo\"\n",
+	}
+	for name, content := range files {
+		if _, err := LoadConfig(writeConfigFile(t, name, content)); err == nil || !strings.Contains(err.Error(), "base_ulr") {
+			t.Errorf("%s: error %v, want one naming base_ulr", name, err)
+		}
+	}
+}
+
+func TestValidateOAuthProviders(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*ServerConfig)
+		valid     bool
+	}{
+		{"none", func(cfg *ServerConfig) {}, true},
+		{"github", func(cfg *ServerConfig) {
+			cfg.GitHubClientID, cfg.GitHubClientSecret = "id", "secret"
+		}, true},
+		{"github without secret", func(cfg *ServerConfig) {
+			cfg.GitHubClientID = "id"
+		}, false},
+		{"self-hosted gitlab", func(cfg *ServerConfig) {
+			cfg.GitLabClientID, cfg.GitLabClientSecret, cfg.GitLabURL = "id", "secret", "https://git.example.com"
+		}, true},
+		{"gitlab with relative url", func(cfg *ServerConfig) {
+			cfg.GitLabClientID, cfg.GitLabClientSecret, cfg.GitLabURL = "id", "secret", "git.example.com"
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.configure(&cfg)
+			if err := cfg.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSessionSecretRequiredInProduction(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("development without SESSION_SECRET: %v", err)
+	}
+
+	t.Setenv("NODE_ENV", "production")
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "SESSION_SECRET") {
+		t.Errorf("production without SESSION_SECRET: %v", err)
+	}
+	cfg.SessionSecret = "too short"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "SESSION_SECRET") {
+		t.Errorf("production with a short SESSION_SECRET: %v", err)
+	}
+	cfg.SessionSecret = strings.Repeat("s", minSessionSecretLength)
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("production with SESSION_SECRET: %v", err)
+	}
+}
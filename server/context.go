@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type contextKey string
+
+const (
+	clientContextKey = contextKey("client")
+)
+
+// ClientInfo identifies the caller of an HTTP request or websocket connection
+type ClientInfo struct {
+	RequestID string
+	User      string
+	IP        string
+	UserAgent string
+	// Token is the access token the caller authenticated with, nil for
+	// browser sessions
+	Token *AccessToken
+}
+
+// Key returns the identity used for per-client limits, the user if logged in
+// and the IP address otherwise. Users come from signed sessions or access
+// tokens, so callers can't pick a fresh key per request.
+func (c *ClientInfo) Key() string {
+	if c.User != "" {
+		return "user:" + c.User
+	}
+	return "ip:" + c.IP
+}
+
+// IsBot reports whether the caller is a bot account
+func (c *ClientInfo) IsBot() bool {
+	return c.Token != nil && c.Token.IsBot
+}
+
+// HasScope reports whether the caller may do what scope allows. Sessions
+// may do everything, access tokens only what their scopes allow, with ADMIN
+// implying the others.
+func (c *ClientInfo) HasScope(scope TokenScope) bool {
+	if c.Token == nil {
+		return true
+	}
+	return slices.Contains(c.Token.Scopes, scope) || slices.Contains(c.Token.Scopes, TokenScopeAdmin)
+}
+
+// withClientInfo stores the caller's identity in the request context so
+// resolvers, gqlgen extensions and log records can read it. The user comes
+// from a verified session cookie only. Websocket connections keep the
+// request ID of their upgrade request.
+func withClientInfo(next http.Handler, sessions *Sessions, trustProxy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &ClientInfo{
+			RequestID: requestID(r),
+			User:      sessions.User(r),
+			IP:        clientIP(r, trustProxy),
+			UserAgent: r.UserAgent(),
+		}
+
+		w.Header().Set("X-Request-ID", info.RequestID)
+		ctx := context.WithValue(r.Context(), clientContextKey, info)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ClientFromContext returns the caller's identity, or an anonymous client if
+// the context didn't come from an HTTP request
+func ClientFromContext(ctx context.Context) *ClientInfo {
+	if info, ok := ctx.Value(clientContextKey).(*ClientInfo); ok {
+		return info
+	}
+	return &ClientInfo{}
+}
+
+// currentUser returns the logged in user or an error for anonymous callers
+func currentUser(ctx context.Context) (string, error) {
+	if user := ClientFromContext(ctx).User; user != "" {
+		return user, nil
+	}
+	return "", forbiddenError("not logged in")
+}
+
+// clientIP returns the remote address, honouring proxy headers only when
+// running behind a trusted proxy such as fly.io's edge
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+			return ip
+		}
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
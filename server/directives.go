@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -16,4 +17,14 @@ func unmarshalTime(v interface{}) (time.Time, error) {
 		return time.Parse(time.RFC3339, timeStr)
 	}
 	return time.Time{}, fmt.Errorf("time should be a string")
-} 
\ No newline at end of file
+}
+
+// hasRoleDirective rejects the field unless the caller has at least the given role
+func hasRoleDirective(resolver *Resolver) func(ctx context.Context, obj interface{}, next graphql.Resolver, role Role) (interface{}, error) {
+	return func(ctx context.Context, obj interface{}, next graphql.Resolver, role Role) (interface{}, error) {
+		if err := resolver.hasRole(ctx, role); err != nil {
+			return nil, err
+		}
+		return next(ctx)
+	}
+}
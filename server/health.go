@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultHealthCheckTimeout = 2 * time.Second
+
+// HealthCheck reports whether a dependency is usable
+type HealthCheck func(ctx context.Context) error
+
+// Health serves /healthz and /readyz. Readiness runs every registered check
+// concurrently, each bounded by the timeout.
+type Health struct {
+	timeout time.Duration
+
+	mutex  sync.RWMutex
+	checks map[string]HealthCheck
+}
+
+type healthStatus struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                  `json:"status"`
+	Checks map[string]healthStatus `json:"checks,omitempty"`
+}
+
+// NewHealth creates a Health whose checks are each bounded by timeout
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{timeout: timeout, checks: make(map[string]HealthCheck)}
+}
+
+// Register adds a readiness check
+func (h *Health) Register(name string, check HealthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks[name] = check
+}
+
+// Liveness only reports that the process is able to serve requests
+func (h *Health) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Readiness reports whether every dependency is reachable
+func (h *Health) Readiness(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	checks := make(map[string]HealthCheck, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mutex.RUnlock()
+
+	resp := healthResponse{Status: "ok", Checks: make(map[string]healthStatus, len(checks))}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			status := healthStatus{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				status.Status = "error"
+				status.Error = err.Error()
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			resp.Checks[name] = status
+			if err != nil {
+				resp.Status = "error"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, resp)
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// readiness calls handler and decodes the JSON it responds with
+func readiness(t *testing.T, handler http.HandlerFunc) (int, healthResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type %q", contentType)
+	}
+	var resp healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%s: %v", rec.Body, err)
+	}
+	return rec.Code, resp
+}
+
+func TestReadiness(t *testing.T) {
+	health := NewHealth(50 * time.Millisecond)
+	health.Register("ok", func(ctx context.Context) error { return nil })
+
+	code, resp := readiness(t, health.Readiness)
+	if code != http.StatusOK || resp.Status != "ok" || resp.Checks["ok"].Status != "ok" || resp.Checks["ok"].Duration == "" {
+		t.Errorf("status %d, body %+v", code, resp)
+	}
+
+	health.Register("failing", func(ctx context.Context) error { return errors.New("connection refused") })
+	health.Register("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	start := time.Now()
+	code, resp = readiness(t, health.Readiness)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, the slow check wasn't cut off", elapsed)
+	}
+	if code != http.StatusServiceUnavailable || resp.Status != "error" {
+		t.Errorf("status %d %q, want 503 error", code, resp.Status)
+	}
+	want := map[string]healthStatus{
+		"ok":      {Status: "ok"},
+		"failing": {Status: "error", Error: "connection refused"},
+		"slow":    {Status: "error", Error: context.DeadlineExceeded.Error()},
+	}
+	for name, status := range want {
+		if got := resp.Checks[name]; got.Status != status.Status || got.Error != status.Error {
+			t.Errorf("check %s: %+v, want %+v", name, got, status)
+		}
+	}
+
+	// Liveness doesn't depend on the checks
+	rec := httptest.NewRecorder()
+	health.Liveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("liveness: status %d", rec.Code)
+	}
+}
+
+func TestServerReadiness(t *testing.T) {
+	s, mr := newTestServer(t, nil)
+	if code, resp := readiness(t, s.handler.ServeHTTP); code != http.StatusOK {
+		t.Fatalf("status %d, body %+v", code, resp)
+	}
+
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	if code, resp := readiness(t, s.handler.ServeHTTP); code != http.StatusServiceUnavailable || resp.Checks["redis"].Status != "error" {
+		t.Errorf("Redis failing: status %d, body %+v", code, resp)
+	}
+	mr.SetError("")
+
+	s.resolver.closeSubscriptions()
+	if code, resp := readiness(t, s.handler.ServeHTTP); code != http.StatusServiceUnavailable || resp.Checks["subscriptions"].Status != "error" {
+		t.Errorf("shutting down: status %d, body %+v", code, resp)
+	}
+}
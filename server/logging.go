@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const redacted = "[REDACTED]"
+
+// secretLogKeys are attributes that never show up in logs. Access token IDs
+// aren't secret and are logged as token_id.
+var secretLogKeys = map[string]bool{
+	"secret":        true,
+	"client_secret": true,
+	"access_token":  true,
+	"token_secret":  true,
+	"password":      true,
+	"authorization": true,
+	"cookie":        true,
+}
+
+// messageLogKeys hold user content, which is only logged if LOG_MESSAGE_BODIES is set
+var messageLogKeys = map[string]bool{
+	"text": true,
+}
+
+// NewLogger creates the logger configured by LOG_LEVEL (debug, info, warn
+// or error), LOG_FORMAT (text or json) and LOG_MESSAGE_BODIES
+func NewLogger(w io.Writer, cfg *ServerConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL %q: %w", cfg.LogLevel, err)
+	}
+	logBodies := cfg.LogMessageBodies
+
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			key := strings.ToLower(a.Key)
+			if secretLogKeys[key] || (messageLogKeys[key] && !logBodies) {
+				return slog.String(a.Key, redacted)
+			}
+			return a
+		},
+	}
+
+	var handler slog.Handler
+	switch format := cfg.LogFormat; format {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// contextHandler adds the request ID, user and trace of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if client, ok := ctx.Value(clientContextKey).(*ClientInfo); ok {
+			if client.RequestID != "" {
+				r.AddAttrs(slog.String("request_id", client.RequestID))
+			}
+			if client.User != "" {
+				r.AddAttrs(slog.String("user", client.User))
+			}
+		}
+		if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+			r.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestID returns the ID the proxy assigned to r, or a new one. Incoming
+// IDs are only kept if they are short and printable.
+func requestID(r *http.Request) string {
+	for _, header := range []string{"X-Request-ID", "Fly-Request-Id"} {
+		id := r.Header.Get(header)
+		if id != "" && len(id) <= 64 && !strings.ContainsFunc(id, func(c rune) bool {
+			return c <= ' ' || c > '~'
+		}) {
+			return id
+		}
+	}
+	return ksuid.New().String()
+}
+
+// redactURL hides the password of a URL such as REDIS_URL
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLogRedaction(t *testing.T) {
+	var out bytes.Buffer
+	cfg := DefaultConfig()
+	cfg.LogFormat = "json"
+	logger, err := NewLogger(&out, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("test",
+		"token_id", "2Bf4tNDlDkU5XOWeFqGjbXt9pQm",
+		"access_token", "gho_secret",
+		"token_secret", "rtc_secret",
+		"Authorization", "Bearer rtc_secret",
+		"text", "a private message",
+	)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		// IDs are needed to trace what happened to a token
+		"token_id":      "2Bf4tNDlDkU5XOWeFqGjbXt9pQm",
+		"access_token":  redacted,
+		"token_secret":  redacted,
+		"Authorization": redacted,
+		"text":          redacted,
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s logged as %v, want %v", key, record[key], value)
+		}
+	}
+}
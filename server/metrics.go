@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// serveMetrics runs the metrics listener until it's shut down
+func serveMetrics(server *http.Server, listener net.Listener) {
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Metrics listener failed", "error", err)
+	}
+}
+
+// maxOperationNames bounds the cardinality of the operation label, since
+// operation names are chosen by clients
+const maxOperationNames = 100
+
+var (
+	graphqlOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_graphql_operations_total",
+		Help: "GraphQL operations by name, type and status (ok, error or rejected before execution).",
+	}, []string{"operation", "type", "status"})
+
+	graphqlDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_graphql_operation_duration_seconds",
+		Help:    "Latency of GraphQL queries and mutations.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "type"})
+
+	websocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_websocket_connections",
+		Help: "Open websocket connections.",
+	})
+
+	activeSubscriptions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chat_subscriptions",
+		Help: "Active subscriptions by topic.",
+	}, []string{"topic"})
+
+	messagesPosted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_posted_total",
+		Help: "Messages posted.",
+	})
+
+	broadcastFanout = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_broadcast_fanout",
+		Help:    "Number of subscribers a broadcast was delivered to.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"topic"})
+
+	broadcastDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_broadcast_dropped_total",
+		Help: "Broadcasts dropped because a subscriber's buffer was full.",
+	}, []string{"topic"})
+
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_redis_command_duration_seconds",
+		Help:    "Latency of Redis commands. Pipelines are reported as a single \"pipeline\" command.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "status"})
+
+	oauthLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_oauth_logins_total",
+		Help: "OAuth logins by provider and result.",
+	}, []string{"provider", "result"})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_webhook_deliveries_total",
+		Help: "Webhook delivery attempts by result.",
+	}, []string{"result"})
+
+	webhookDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_webhook_dead_letters_total",
+		Help: "Webhook deliveries given up on after every attempt failed.",
+	})
+)
+
+type metricsContextKey struct{}
+
+// Metrics is a gqlgen extension that records operation counts and latency
+type Metrics struct {
+	mutex sync.Mutex
+	names map[string]bool
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{names: make(map[string]bool)}
+}
+
+func (m *Metrics) ExtensionName() string {
+	return "Metrics"
+}
+
+func (m *Metrics) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+// operationLabels returns the name and type labels of the operation in ctx
+func (m *Metrics) operationLabels(ctx context.Context) (string, string) {
+	if !graphql.HasOperationContext(ctx) {
+		return "unknown", "unknown"
+	}
+	rc := graphql.GetOperationContext(ctx)
+	if rc.Operation == nil {
+		return "unknown", "unknown"
+	}
+
+	name := rc.Operation.Name
+	if name == "" {
+		name = "anonymous"
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.names[name] {
+		if len(m.names) >= maxOperationNames {
+			name = "other"
+		} else {
+			m.names[name] = true
+		}
+	}
+	return name, strings.ToLower(string(rc.Operation.Operation))
+}
+
+// InterceptOperation records executed operations. Subscriptions are counted
+// once when they start, queries and mutations when their response is ready.
+func (m *Metrics) InterceptOperation(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	name, opType := m.operationLabels(ctx)
+	start := graphql.GetOperationContext(ctx).Stats.OperationStart
+
+	ctx = context.WithValue(ctx, metricsContextKey{}, true)
+	if opType == "subscription" {
+		graphqlOperations.WithLabelValues(name, opType, "ok").Inc()
+		return next(ctx)
+	}
+	handler := next(ctx)
+
+	first := true
+	return func(ctx context.Context) *graphql.Response {
+		resp := handler(ctx)
+		if !first {
+			return resp
+		}
+		first = false
+
+		status := "ok"
+		if resp != nil && len(resp.Errors) > 0 {
+			status = "error"
+		}
+		graphqlOperations.WithLabelValues(name, opType, status).Inc()
+		graphqlDuration.WithLabelValues(name, opType).Observe(time.Since(start).Seconds())
+		return resp
+	}
+}
+
+// InterceptResponse counts operations that were rejected before execution,
+// e.g. by validation, query limits or rate limiting
+func (m *Metrics) InterceptResponse(ctx context.Context, next graphql.ResponseHandler) *graphql.Response {
+	if ctx.Value(metricsContextKey{}) == nil {
+		name, opType := m.operationLabels(ctx)
+		graphqlOperations.WithLabelValues(name, opType, "rejected").Inc()
+	}
+	return next(ctx)
+}
+
+// countWebsockets tracks open websocket connections. The gqlgen websocket
+// transport blocks until the connection is closed.
+func countWebsockets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			websocketConnections.Inc()
+			defer websocketConnections.Dec()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type redisStartKey struct{}
+
+// redisMetricsHook records the latency of every Redis command
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observeRedis(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	observeRedis(ctx, "pipeline", err)
+	return nil
+}
+
+func observeRedis(ctx context.Context, command string, err error) {
+	start, ok := ctx.Value(redisStartKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	status := "ok"
+	if err != nil && err != redis.Nil {
+		status = "error"
+	}
+	redisDuration.WithLabelValues(command, status).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestMetricsListener(t *testing.T) {
+	metricsAddr := freeAddr(t)
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.ListenAddr = freeAddr(t)
+		cfg.MetricsAddr = metricsAddr
+	})
+	go s.Serve()
+
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		resp, err := http.Get("http://" + metricsAddr + "/metrics")
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(data)
+		break
+	}
+	if !strings.Contains(body, "chat_messages_posted_total") {
+		t.Errorf("METRICS_ADDR serves %q", body)
+	}
+
+	// The public listener doesn't expose them
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "chat_") {
+		t.Errorf("/metrics on the app listener: %d %q", rec.Code, rec.Body)
+	}
+}
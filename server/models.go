@@ -2,8 +2,29 @@ package server
 
 // Message represents a chat message
 type Message struct {
-	ID        string `json:"id"`
-	User      string `json:"user"`
-	Text      string `json:"text"`
-	CreatedAt Time   `json:"createdAt"`
-} 
\ No newline at end of file
+	ID           string         `json:"id"`
+	User         string         `json:"user"`
+	Text         string         `json:"text"`
+	CreatedAt    Time           `json:"createdAt"`
+	Attachments  []*Attachment  `json:"attachments,omitempty"`
+	LinkPreviews []*LinkPreview `json:"linkPreviews,omitempty"`
+	Moderation   *Moderation    `json:"moderation,omitempty"`
+	Hidden       bool           `json:"hidden,omitempty"`
+	IsBot        bool           `json:"isBot,omitempty"`
+}
+
+// Moderation records the outcome of the moderation pipeline for a message
+type Moderation struct {
+	Status  ModerationStatus `json:"status"`
+	Reasons []string         `json:"reasons"`
+}
+
+// Attachment represents a file uploaded alongside a message
+type Attachment struct {
+	ID           string  `json:"id"`
+	Filename     string  `json:"filename"`
+	ContentType  string  `json:"contentType"`
+	Size         int64   `json:"size"`
+	URL          string  `json:"url"`
+	ThumbnailURL *string `json:"thumbnailUrl,omitempty"`
+}
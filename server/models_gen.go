@@ -0,0 +1,344 @@
+// Code generated by github.com/99designs/gqlgen, DO NOT EDIT.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type AuditLogConnection struct {
+	Entries     []*AuditEvent `json:"entries"`
+	EndCursor   *string       `json:"endCursor,omitempty"`
+	HasNextPage bool          `json:"hasNextPage"`
+}
+
+type AuditLogFilter struct {
+	Action *string `json:"action,omitempty"`
+	Actor  *string `json:"actor,omitempty"`
+	Target *string `json:"target,omitempty"`
+	Since  *Time   `json:"since,omitempty"`
+	Until  *Time   `json:"until,omitempty"`
+}
+
+type NewAccessToken struct {
+	// The secret to send as Authorization: Bearer. It's only returned once.
+	Token       string       `json:"token"`
+	AccessToken *AccessToken `json:"accessToken"`
+}
+
+type NewWebhook struct {
+	Webhook *Webhook `json:"webhook"`
+	// The key deliveries are signed with. It's only returned once.
+	Secret string `json:"secret"`
+}
+
+type ModerationDecision string
+
+const (
+	ModerationDecisionApprove ModerationDecision = "APPROVE"
+	ModerationDecisionReject  ModerationDecision = "REJECT"
+)
+
+var AllModerationDecision = []ModerationDecision{
+	ModerationDecisionApprove,
+	ModerationDecisionReject,
+}
+
+func (e ModerationDecision) IsValid() bool {
+	switch e {
+	case ModerationDecisionApprove, ModerationDecisionReject:
+		return true
+	}
+	return false
+}
+
+func (e ModerationDecision) String() string {
+	return string(e)
+}
+
+func (e *ModerationDecision) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ModerationDecision(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ModerationDecision", str)
+	}
+	return nil
+}
+
+func (e ModerationDecision) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ModerationStatus string
+
+const (
+	ModerationStatusApproved ModerationStatus = "APPROVED"
+	ModerationStatusMasked   ModerationStatus = "MASKED"
+	ModerationStatusFlagged  ModerationStatus = "FLAGGED"
+)
+
+var AllModerationStatus = []ModerationStatus{
+	ModerationStatusApproved,
+	ModerationStatusMasked,
+	ModerationStatusFlagged,
+}
+
+func (e ModerationStatus) IsValid() bool {
+	switch e {
+	case ModerationStatusApproved, ModerationStatusMasked, ModerationStatusFlagged:
+		return true
+	}
+	return false
+}
+
+func (e ModerationStatus) String() string {
+	return string(e)
+}
+
+func (e *ModerationStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ModerationStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ModerationStatus", str)
+	}
+	return nil
+}
+
+func (e ModerationStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ReportAction string
+
+const (
+	ReportActionDismiss       ReportAction = "DISMISS"
+	ReportActionHideMessage   ReportAction = "HIDE_MESSAGE"
+	ReportActionDeleteMessage ReportAction = "DELETE_MESSAGE"
+	ReportActionBanAuthor     ReportAction = "BAN_AUTHOR"
+)
+
+var AllReportAction = []ReportAction{
+	ReportActionDismiss,
+	ReportActionHideMessage,
+	ReportActionDeleteMessage,
+	ReportActionBanAuthor,
+}
+
+func (e ReportAction) IsValid() bool {
+	switch e {
+	case ReportActionDismiss, ReportActionHideMessage, ReportActionDeleteMessage, ReportActionBanAuthor:
+		return true
+	}
+	return false
+}
+
+func (e ReportAction) String() string {
+	return string(e)
+}
+
+func (e *ReportAction) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ReportAction(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ReportAction", str)
+	}
+	return nil
+}
+
+func (e ReportAction) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ReportStatus string
+
+const (
+	ReportStatusOpen      ReportStatus = "OPEN"
+	ReportStatusResolved  ReportStatus = "RESOLVED"
+	ReportStatusDismissed ReportStatus = "DISMISSED"
+)
+
+var AllReportStatus = []ReportStatus{
+	ReportStatusOpen,
+	ReportStatusResolved,
+	ReportStatusDismissed,
+}
+
+func (e ReportStatus) IsValid() bool {
+	switch e {
+	case ReportStatusOpen, ReportStatusResolved, ReportStatusDismissed:
+		return true
+	}
+	return false
+}
+
+func (e ReportStatus) String() string {
+	return string(e)
+}
+
+func (e *ReportStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ReportStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ReportStatus", str)
+	}
+	return nil
+}
+
+func (e ReportStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type Role string
+
+const (
+	RoleOwner  Role = "OWNER"
+	RoleAdmin  Role = "ADMIN"
+	RoleMember Role = "MEMBER"
+)
+
+var AllRole = []Role{
+	RoleOwner,
+	RoleAdmin,
+	RoleMember,
+}
+
+func (e Role) IsValid() bool {
+	switch e {
+	case RoleOwner, RoleAdmin, RoleMember:
+		return true
+	}
+	return false
+}
+
+func (e Role) String() string {
+	return string(e)
+}
+
+func (e *Role) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Role(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Role", str)
+	}
+	return nil
+}
+
+func (e Role) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type TokenScope string
+
+const (
+	// Run queries and subscriptions
+	TokenScopeRead TokenScope = "READ"
+	// Post messages
+	TokenScopePost TokenScope = "POST"
+	// Everything the owner's role allows
+	TokenScopeAdmin TokenScope = "ADMIN"
+)
+
+var AllTokenScope = []TokenScope{
+	TokenScopeRead,
+	TokenScopePost,
+	TokenScopeAdmin,
+}
+
+func (e TokenScope) IsValid() bool {
+	switch e {
+	case TokenScopeRead, TokenScopePost, TokenScopeAdmin:
+		return true
+	}
+	return false
+}
+
+func (e TokenScope) String() string {
+	return string(e)
+}
+
+func (e *TokenScope) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = TokenScope(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid TokenScope", str)
+	}
+	return nil
+}
+
+func (e TokenScope) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type WebhookEvent string
+
+const (
+	WebhookEventMessagePosted WebhookEvent = "MESSAGE_POSTED"
+	// A message got link previews or was hidden or deleted
+	WebhookEventMessageUpdated WebhookEvent = "MESSAGE_UPDATED"
+	// A user logged in for the first time
+	WebhookEventUserJoined WebhookEvent = "USER_JOINED"
+	// Sent by testWebhook, webhooks can't subscribe to it
+	WebhookEventPing WebhookEvent = "PING"
+)
+
+var AllWebhookEvent = []WebhookEvent{
+	WebhookEventMessagePosted,
+	WebhookEventMessageUpdated,
+	WebhookEventUserJoined,
+	WebhookEventPing,
+}
+
+func (e WebhookEvent) IsValid() bool {
+	switch e {
+	case WebhookEventMessagePosted, WebhookEventMessageUpdated, WebhookEventUserJoined, WebhookEventPing:
+		return true
+	}
+	return false
+}
+
+func (e WebhookEvent) String() string {
+	return string(e)
+}
+
+func (e *WebhookEvent) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = WebhookEvent(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid WebhookEvent", str)
+	}
+	return nil
+}
+
+func (e WebhookEvent) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ModerationAction is what a filter wants done with a message
+type ModerationAction int
+
+const (
+	ActionAllow ModerationAction = iota
+	ActionMask
+	ActionFlag
+	ActionReject
+)
+
+func parseModerationAction(value string, fallback ModerationAction) (ModerationAction, error) {
+	switch value {
+	case "":
+		return fallback, nil
+	case "mask":
+		return ActionMask, nil
+	case "flag":
+		return ActionFlag, nil
+	case "reject":
+		return ActionReject, nil
+	default:
+		return ActionAllow, fmt.Errorf("unknown moderation action %q", value)
+	}
+}
+
+// ModerationResult is the verdict of a single filter
+type ModerationResult struct {
+	Action ModerationAction
+	Reason string
+	// Text replaces the message text when Action is ActionMask
+	Text string
+}
+
+// ModerationFilter inspects a message before it is stored
+type ModerationFilter interface {
+	Check(ctx context.Context, msg *Message) ModerationResult
+}
+
+// ModerationRecorder is implemented by filters that keep track of the
+// messages that were stored, such as the recent messages of a user
+type ModerationRecorder interface {
+	Record(ctx context.Context, msg *Message) error
+}
+
+// ModerationConfig configures the filters of the moderation pipeline
+type ModerationConfig struct {
+	MaxLength       int
+	Wordlist        []string
+	WordlistAction  ModerationAction
+	Blocklist       []*regexp.Regexp
+	BlocklistAction ModerationAction
+	MaxLinks        int
+	RepeatWindow    time.Duration
+}
+
+// readLines returns the non-empty lines of a file, skipping # comments
+func readLines(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Moderator runs messages through a list of filters in order
+type Moderator struct {
+	redis   *redis.Client
+	filters []ModerationFilter
+}
+
+func NewModerator(redisClient *redis.Client, cfg ModerationConfig) *Moderator {
+	filters := []ModerationFilter{MaxLengthFilter{Max: cfg.MaxLength}}
+	if len(cfg.Blocklist) > 0 {
+		filters = append(filters, RegexFilter{Patterns: cfg.Blocklist, Action: cfg.BlocklistAction})
+	}
+	if len(cfg.Wordlist) > 0 {
+		filters = append(filters, NewWordlistFilter(cfg.Wordlist, cfg.WordlistAction))
+	}
+	filters = append(filters, &SpamFilter{redis: redisClient, MaxLinks: cfg.MaxLinks, RepeatWindow: cfg.RepeatWindow})
+
+	return &Moderator{redis: redisClient, filters: filters}
+}
+
+// Moderate applies every filter to msg, masking its text and recording the
+// outcome on msg.Moderation. A rejected message returns an error.
+func (m *Moderator) Moderate(ctx context.Context, msg *Message) error {
+	moderation := &Moderation{Status: ModerationStatusApproved, Reasons: []string{}}
+
+	for _, filter := range m.filters {
+		result := filter.Check(ctx, msg)
+		switch result.Action {
+		case ActionReject:
+			err := gqlerror.Errorf("message rejected: %s", result.Reason)
+			err.Extensions = map[string]interface{}{"code": "MESSAGE_REJECTED", "reason": result.Reason}
+			return err
+		case ActionMask:
+			msg.Text = result.Text
+			if moderation.Status == ModerationStatusApproved {
+				moderation.Status = ModerationStatusMasked
+			}
+			moderation.Reasons = append(moderation.Reasons, result.Reason)
+		case ActionFlag:
+			moderation.Status = ModerationStatusFlagged
+			moderation.Reasons = append(moderation.Reasons, result.Reason)
+		}
+	}
+
+	msg.Moderation = moderation
+	return nil
+}
+
+// Enqueue adds a flagged message to the review queue
+func (m *Moderator) Enqueue(ctx context.Context, msg *Message) error {
+	if msg.Moderation == nil || msg.Moderation.Status != ModerationStatusFlagged {
+		return nil
+	}
+	slog.InfoContext(ctx, "Message flagged for review", "message", msg.ID, "reasons", strings.Join(msg.Moderation.Reasons, ", "))
+	return m.redis.ZAdd(ctx, "moderation:queue", &redis.Z{
+		Score:  float64(msg.CreatedAt.Unix()),
+		Member: msg.ID,
+	}).Err()
+}
+
+// Record lets the filters remember a message once it was stored, so that
+// messages that were rejected or failed to save don't count against the user
+func (m *Moderator) Record(ctx context.Context, msg *Message) error {
+	var errs []error
+	for _, filter := range m.filters {
+		if recorder, ok := filter.(ModerationRecorder); ok {
+			errs = append(errs, recorder.Record(ctx, msg))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MaxLengthFilter rejects messages longer than Max characters
+type MaxLengthFilter struct {
+	Max int
+}
+
+func (f MaxLengthFilter) Check(ctx context.Context, msg *Message) ModerationResult {
+	if f.Max > 0 && len([]rune(msg.Text)) > f.Max {
+		return ModerationResult{Action: ActionReject, Reason: fmt.Sprintf("message is longer than %d characters", f.Max)}
+	}
+	return ModerationResult{}
+}
+
+// RegexFilter applies Action to messages matching any of the patterns
+type RegexFilter struct {
+	Patterns []*regexp.Regexp
+	Action   ModerationAction
+}
+
+func (f RegexFilter) Check(ctx context.Context, msg *Message) ModerationResult {
+	for _, re := range f.Patterns {
+		if re.MatchString(msg.Text) {
+			result := ModerationResult{Action: f.Action, Reason: "matches blocked pattern"}
+			if f.Action == ActionMask {
+				result.Text = re.ReplaceAllStringFunc(msg.Text, maskWord)
+			}
+			return result
+		}
+	}
+	return ModerationResult{}
+}
+
+// WordlistFilter matches whole words case-insensitively, e.g. a profanity
+// list. Words end at any rune that isn't a letter, number or underscore, so
+// unlike \b this works for text that isn't ASCII.
+type WordlistFilter struct {
+	pattern *regexp.Regexp
+	action  ModerationAction
+}
+
+func NewWordlistFilter(words []string, action ModerationAction) *WordlistFilter {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return &WordlistFilter{
+		pattern: regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)`),
+		action:  action,
+	}
+}
+
+func (f *WordlistFilter) Check(ctx context.Context, msg *Message) ModerationResult {
+	matches := f.wholeWords(msg.Text)
+	if len(matches) == 0 {
+		return ModerationResult{}
+	}
+	result := ModerationResult{Action: f.action, Reason: "contains blocked words"}
+	if f.action == ActionMask {
+		var masked strings.Builder
+		last := 0
+		for _, match := range matches {
+			masked.WriteString(msg.Text[last:match[0]])
+			masked.WriteString(maskWord(msg.Text[match[0]:match[1]]))
+			last = match[1]
+		}
+		masked.WriteString(msg.Text[last:])
+		result.Text = masked.String()
+	}
+	return result
+}
+
+// wholeWords returns the matches in text that aren't part of a longer word
+func (f *WordlistFilter) wholeWords(text string) [][]int {
+	var matches [][]int
+	for _, match := range f.pattern.FindAllStringIndex(text, -1) {
+		before, _ := utf8.DecodeLastRuneInString(text[:match[0]])
+		after, _ := utf8.DecodeRuneInString(text[match[1]:])
+		if !isWordRune(before) && !isWordRune(after) {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+func maskWord(word string) string {
+	return strings.Repeat("*", len([]rune(word)))
+}
+
+// minRepeatLength is the shortest text SpamFilter checks for repeats, short
+// replies such as "ok" or "thanks" are naturally sent again
+const minRepeatLength = 10
+
+// SpamFilter rejects a user posting the same text repeatedly and flags link
+// flooding. Other users may post the same text.
+type SpamFilter struct {
+	redis        *redis.Client
+	MaxLinks     int
+	RepeatWindow time.Duration
+}
+
+var _ ModerationRecorder = (*SpamFilter)(nil)
+
+func (f *SpamFilter) Check(ctx context.Context, msg *Message) ModerationResult {
+	// Repeats are checked first, a link flood sent again is still rejected
+	if key, hash, ok := f.repeatKey(msg); ok {
+		recent, err := f.redis.LRange(ctx, key, 0, -1).Result()
+		if err != nil && err != redis.Nil {
+			slog.WarnContext(ctx, "Failed to load recent messages", "user", msg.User, "error", err)
+		}
+		for _, h := range recent {
+			if h == hash {
+				return ModerationResult{Action: ActionReject, Reason: "repeated message"}
+			}
+		}
+	}
+
+	if f.MaxLinks > 0 && len(urlPattern.FindAllString(msg.Text, -1)) > f.MaxLinks {
+		return ModerationResult{Action: ActionFlag, Reason: fmt.Sprintf("more than %d links", f.MaxLinks)}
+	}
+	return ModerationResult{}
+}
+
+// Record remembers a hash of the user's stored message for the repeat window
+func (f *SpamFilter) Record(ctx context.Context, msg *Message) error {
+	key, hash, ok := f.repeatKey(msg)
+	if !ok {
+		return nil
+	}
+	pipe := f.redis.TxPipeline()
+	pipe.LPush(ctx, key, hash)
+	pipe.LTrim(ctx, key, 0, 4)
+	pipe.Expire(ctx, key, f.RepeatWindow)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// repeatKey returns the list of the user's recent message hashes and the hash
+// of msg, or false if msg isn't checked for repeats
+func (f *SpamFilter) repeatKey(msg *Message) (string, string, bool) {
+	text := strings.Join(strings.Fields(strings.ToLower(msg.Text)), " ")
+	if f.RepeatWindow <= 0 || len([]rune(text)) < minRepeatLength {
+		return "", "", false
+	}
+	return "moderation:recent:" + msg.User, sha256Hex([]byte(text)), true
+}
+
+// resolveModeration applies an admin's review of a flagged message and takes
+// it off the queue. Approved messages are kept, rejected ones are deleted.
+func (r *Resolver) resolveModeration(ctx context.Context, id string, decision ModerationDecision) error {
+	actor := ClientFromContext(ctx).User
+	if err := r.redis.ZScore(ctx, "moderation:queue", id).Err(); err == redis.Nil {
+		return fmt.Errorf("message %s isn't awaiting review", id)
+	} else if err != nil {
+		return err
+	}
+
+	switch decision {
+	case ModerationDecisionApprove:
+		_, err := r.updateMessage(ctx, id, func(stored *Message) {
+			if stored.Moderation != nil {
+				stored.Moderation.Status = ModerationStatusApproved
+			}
+		})
+		if err != nil && !errors.Is(err, errMessageNotFound) {
+			return err
+		}
+		if err := r.redis.ZRem(ctx, "moderation:queue", id).Err(); err != nil {
+			return err
+		}
+	case ModerationDecisionReject:
+		msg, err := r.loadMessage(ctx, id)
+		if errors.Is(err, errMessageNotFound) {
+			// Nothing left to delete, only the queue entry
+			err = r.redis.ZRem(ctx, "moderation:queue", id).Err()
+		} else if err == nil {
+			// deleteMessage also takes it off the queue
+			err = r.deleteMessage(ctx, msg)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown decision %s", decision)
+	}
+
+	r.logModeration(ctx, actor, decision.String()+"_MESSAGE", id, "")
+	return nil
+}
+
+// moderationQueue returns the flagged messages awaiting review, oldest first
+func (r *Resolver) moderationQueue(ctx context.Context) ([]*Message, error) {
+	ids, err := r.redis.ZRange(ctx, "moderation:queue", 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []*Message{}
+	for _, id := range ids {
+		message, err := r.loadMessage(ctx, id)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpamFilterRepeats(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	filter := &SpamFilter{redis: s.redis, MaxLinks: 2, RepeatWindow: time.Minute}
+	ctx := context.Background()
+
+	// Only stored messages count, a check on its own doesn't
+	unsaved := &Message{User: "alice", Text: "a message that failed to save"}
+	for i := 0; i < 2; i++ {
+		if result := filter.Check(ctx, unsaved); result.Action != ActionAllow {
+			t.Fatalf("unsaved message checked again: %+v", result)
+		}
+	}
+
+	const links = "https://a.example https://b.example https://c.example"
+	posts := []struct {
+		user   string
+		text   string
+		action ModerationAction
+	}{
+		{"alice", "ok", ActionAllow},
+		{"alice", "ok", ActionAllow},
+		{"alice", "Thanks!", ActionAllow},
+		{"alice", "Thanks!", ActionAllow},
+		{"alice", "buy cheap followers now", ActionAllow},
+		{"alice", "buy cheap followers now", ActionReject},
+		{"alice", "  Buy cheap   FOLLOWERS now ", ActionReject},
+		// A link flood is flagged once and rejected when it's sent again
+		{"alice", links, ActionFlag},
+		{"alice", links, ActionReject},
+		// Other users aren't affected by alice's messages
+		{"bob", "buy cheap followers now", ActionAllow},
+		{"bob", "ok", ActionAllow},
+	}
+	for i, post := range posts {
+		msg := &Message{User: post.user, Text: post.text}
+		result := filter.Check(ctx, msg)
+		if result.Action != post.action {
+			t.Errorf("post %d by %s %q: action %v, want %v", i, post.user, post.text, result.Action, post.action)
+		}
+		if result.Action != ActionReject {
+			if err := filter.Record(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestWordlistFilter(t *testing.T) {
+	filter := NewWordlistFilter([]string{"spam", "café"}, ActionMask)
+	tests := []struct {
+		text   string
+		masked string
+	}{
+		{"no blocked words", ""},
+		{"SPAM and spam!", "**** and ****!"},
+		{"spammer", ""},
+		{"_spam", ""},
+		// Boundaries are Unicode aware, \b would match inside both of these
+		{"spamé", ""},
+		{"naïvespam", ""},
+		{"un café, s'il vous plaît", "un ****, s'il vous plaît"},
+		{"«café»", "«****»"},
+	}
+	for _, tt := range tests {
+		result := filter.Check(context.Background(), &Message{Text: tt.text})
+		if matched := result.Action == ActionMask; matched != (tt.masked != "") || result.Text != tt.masked {
+			t.Errorf("%q: action %v, text %q, want %q", tt.text, result.Action, result.Text, tt.masked)
+		}
+	}
+}
+
+// newModerationServer flags messages containing "spamword" and makes owner
+// an owner
+func newModerationServer(t *testing.T) *Server {
+	t.Helper()
+	wordlist := filepath.Join(t.TempDir(), "words.txt")
+	if err := os.WriteFile(wordlist, []byte("spamword\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.OwnerUsers = []string{"owner"}
+		cfg.ModerationWordlist = wordlist
+		cfg.ModerationWordlistAction = "flag"
+	})
+	return s
+}
+
+func TestModerationIsAdminOnly(t *testing.T) {
+	s := newModerationServer(t)
+	postTestMessage(t, s, "alice", "a spamword message")
+
+	const query = `{ messages { id moderation { status reasons } } }`
+	result := doGraphQL(t, s, query, nil, sessionFor(s, "bob"))
+	if code := result.errorCode(); code != "FORBIDDEN" {
+		t.Errorf("member got error code %q, want FORBIDDEN", code)
+	}
+	var data struct {
+		Messages []struct{ Moderation *Moderation }
+	}
+	if err := json.Unmarshal(result.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Messages) != 1 || data.Messages[0].Moderation != nil {
+		t.Errorf("member sees %s", result.Data)
+	}
+
+	result = doGraphQL(t, s, query, nil, sessionFor(s, "owner"))
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if err := json.Unmarshal(result.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Messages) != 1 || data.Messages[0].Moderation == nil || data.Messages[0].Moderation.Status != ModerationStatusFlagged {
+		t.Errorf("admin sees %s", result.Data)
+	}
+
+	// The REST API hides it the same way
+	for user, visible := range map[string]bool{"bob": false, "owner": true} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil)
+		req.AddCookie(sessionFor(s, user))
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if got := strings.Contains(rec.Body.String(), `"moderation"`); got != visible {
+			t.Errorf("%s: moderation in REST response %v, want %v", user, got, visible)
+		}
+	}
+}
+
+func TestResolveModeration(t *testing.T) {
+	s := newModerationServer(t)
+	approved := postTestMessage(t, s, "alice", "first spamword message")
+	rejected := postTestMessage(t, s, "alice", "second spamword message")
+
+	const mutation = `mutation($id: ID!, $decision: ModerationDecision!) { resolveModeration(id: $id, decision: $decision) }`
+	resolve := func(user, id string, decision ModerationDecision) *graphqlResult {
+		return doGraphQL(t, s, mutation, map[string]interface{}{"id": id, "decision": decision}, sessionFor(s, user))
+	}
+
+	if code := resolve("bob", approved, ModerationDecisionApprove).errorCode(); code != "FORBIDDEN" {
+		t.Errorf("member got error code %q, want FORBIDDEN", code)
+	}
+	decisions := []struct {
+		id       string
+		decision ModerationDecision
+	}{
+		{approved, ModerationDecisionApprove},
+		{rejected, ModerationDecisionReject},
+	}
+	for _, d := range decisions {
+		if result := resolve("owner", d.id, d.decision); len(result.Errors) > 0 {
+			t.Fatalf("%s: %v", d.decision, result.Errors)
+		}
+		// A message is only reviewed once
+		if result := resolve("owner", d.id, d.decision); len(result.Errors) == 0 {
+			t.Errorf("%s was resolved twice", d.decision)
+		}
+	}
+
+	queue, err := s.resolver.moderationQueue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 0 {
+		t.Errorf("%d messages left in the queue", len(queue))
+	}
+
+	msg, err := s.resolver.loadMessage(context.Background(), approved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Moderation.Status != ModerationStatusApproved || len(msg.Moderation.Reasons) == 0 {
+		t.Errorf("approved message has moderation %+v", msg.Moderation)
+	}
+	if _, err := s.resolver.loadMessage(context.Background(), rejected); err == nil {
+		t.Error("rejected message still exists")
+	}
+
+	log, err := s.resolver.moderationLog(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].Action != "REJECT_MESSAGE" || log[1].Action != "APPROVE_MESSAGE" || log[0].Actor != "owner" {
+		t.Errorf("moderation log %+v", log)
+	}
+}
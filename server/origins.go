@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may call the API, both for CORS
+// and for websocket upgrades. Patterns are origins such as
+// https://chat.example.com, https://*.example.com for any subdomain, or * for
+// every origin.
+type OriginPolicy struct {
+	any      bool
+	exact    map[string]bool
+	suffixes []originSuffix
+}
+
+type originSuffix struct {
+	scheme string
+	suffix string // ".example.com" or ".example.com:8443"
+}
+
+// NewOriginPolicy parses the ALLOWED_ORIGINS patterns
+func NewOriginPolicy(patterns []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{exact: make(map[string]bool)}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			p.any = true
+			continue
+		}
+		u, err := url.Parse(pattern)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", pattern)
+		}
+		scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+		if rest, ok := strings.CutPrefix(host, "*."); ok {
+			if rest == "" || strings.Contains(rest, "*") {
+				return nil, fmt.Errorf("invalid origin %q, only a leading *. is allowed", pattern)
+			}
+			p.suffixes = append(p.suffixes, originSuffix{scheme: scheme, suffix: "." + rest})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("invalid origin %q, only a leading *. is allowed", pattern)
+		}
+		p.exact[scheme+"://"+host] = true
+	}
+	return p, nil
+}
+
+// Allowed reports whether origin matches one of the patterns. A wildcard
+// matches subdomains only, https://*.example.com does not allow
+// https://example.com.
+func (p *OriginPolicy) Allowed(origin string) bool {
+	if p.any {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.User != nil {
+		return false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if p.exact[scheme+"://"+host] {
+		return true
+	}
+	for _, s := range p.suffixes {
+		if s.scheme == scheme && strings.HasSuffix(host, s.suffix) && len(host) > len(s.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin is used as the websocket upgrader's CheckOrigin. Browsers always
+// send an Origin header with websocket handshakes, so requests without one come
+// from other clients and can't be used for cross-site websocket hijacking.
+func (p *OriginPolicy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if p.Allowed(origin) {
+		return true
+	}
+	slog.WarnContext(r.Context(), "Rejected websocket from disallowed origin", "origin", origin)
+	return false
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginPolicyAllowed(t *testing.T) {
+	policy, err := NewOriginPolicy([]string{"https://chat.example.com", "https://*.example.org", "http://localhost:3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://chat.example.com", true},
+		{"https://CHAT.example.com", true},
+		{"http://chat.example.com", false},
+		{"https://chat.example.com.evil.com", false},
+		{"https://evilchat.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://a.example.org", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"https://user@chat.example.com", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if allowed := policy.Allowed(tt.origin); allowed != tt.allowed {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.origin, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestOriginPolicyInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"chat.example.com", "https://*", "https://a.*.example.com", "https://example.com/path"} {
+		if _, err := NewOriginPolicy([]string{pattern}); err == nil {
+			t.Errorf("NewOriginPolicy(%q) succeeded", pattern)
+		}
+	}
+}
+
+// TestWebsocketOrigin checks that a page on another site can't open a
+// websocket with the visitor's session cookie
+func TestWebsocketOrigin(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.AllowedOrigins = []string{"https://chat.example.com"}
+	})
+	server := httptest.NewServer(s.handler)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/graphql"
+
+	tests := []struct {
+		name   string
+		origin string
+		status int
+	}{
+		{"foreign origin", "https://evil.example.net", http.StatusForbidden},
+		{"lookalike origin", "https://chat.example.com.evil.net", http.StatusForbidden},
+		{"allowed origin", "https://chat.example.com", http.StatusSwitchingProtocols},
+		// Browsers always send Origin, so clients without one aren't pages
+		{"no origin", "", http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Cookie", sessionFor(s, "alice").String())
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+			conn, resp, err := dialer.Dial(url, header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("no response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
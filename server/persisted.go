@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/errcode"
+	"github.com/go-redis/redis/v8"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const persistedQueryTTL = 24 * time.Hour
+
+// RedisQueryCache stores automatic persisted queries in Redis so every
+// instance knows a hash once one of them has seen the query
+type RedisQueryCache struct {
+	redis *redis.Client
+}
+
+var _ graphql.Cache = &RedisQueryCache{}
+
+func NewRedisQueryCache(redisClient *redis.Client) *RedisQueryCache {
+	return &RedisQueryCache{redis: redisClient}
+}
+
+func (c *RedisQueryCache) Get(ctx context.Context, key string) (interface{}, bool) {
+	query, err := c.redis.Get(ctx, "apq:"+key).Result()
+	if err != nil {
+		return nil, false
+	}
+	return query, true
+}
+
+func (c *RedisQueryCache) Add(ctx context.Context, key string, value interface{}) {
+	c.redis.Set(ctx, "apq:"+key, value, persistedQueryTTL)
+}
+
+// LoadPersistedQueries reads a manifest mapping SHA-256 hashes to query
+// documents, as written by `npm run persisted-queries` in the frontend
+func LoadPersistedQueries(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest map[string]string
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid persisted query manifest %s: %w", path, err)
+	}
+
+	// Don't trust the manifest's keys, a stale hash would silently reject the query
+	for hash, query := range manifest {
+		if queryHash(query) != hash {
+			return nil, fmt.Errorf("persisted query manifest %s: hash %s does not match its query", path, hash)
+		}
+	}
+	return manifest, nil
+}
+
+func queryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// AllowList is a gqlgen extension that only executes operations registered
+// in a persisted query manifest. Clients may send either the full query or
+// just its hash using the APQ request format.
+type AllowList struct {
+	queries map[string]string
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationParameterMutator
+} = &AllowList{}
+
+func NewAllowList(queries map[string]string) *AllowList {
+	return &AllowList{queries: queries}
+}
+
+func (a *AllowList) ExtensionName() string {
+	return "AllowList"
+}
+
+func (a *AllowList) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (a *AllowList) MutateOperationParameters(ctx context.Context, params *graphql.RawParams) *gqlerror.Error {
+	var hash string
+	if persisted, ok := params.Extensions["persistedQuery"].(map[string]interface{}); ok {
+		hash, _ = persisted["sha256Hash"].(string)
+	}
+
+	if params.Query != "" {
+		if hash != "" && queryHash(params.Query) != hash {
+			return gqlerror.Errorf("provided APQ hash does not match query")
+		}
+		hash = queryHash(params.Query)
+	}
+
+	query, ok := a.queries[hash]
+	if !ok {
+		err := gqlerror.Errorf("operation is not in the list of allowed queries")
+		errcode.Set(err, "OPERATION_NOT_ALLOWED")
+		return err
+	}
+	params.Query = query
+	return nil
+}
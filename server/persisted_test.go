@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// doPersisted sends a query the way the frontend's persisted query link
+// does, with its hash in the extensions and the query itself only if
+// includeQuery is set
+func doPersisted(t *testing.T, s *Server, query string, includeQuery bool) *graphqlResult {
+	t.Helper()
+	params := map[string]interface{}{
+		"extensions": map[string]interface{}{
+			"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": queryHash(query)},
+		},
+	}
+	if includeQuery {
+		params["query"] = query
+	}
+	body, _ := json.Marshal(params)
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(sessionFor(s, "alice"))
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	var result graphqlResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	return &result
+}
+
+func TestAutomaticPersistedQueries(t *testing.T) {
+	for _, cache := range []string{"memory", "redis"} {
+		t.Run(cache, func(t *testing.T) {
+			s, _ := newTestServer(t, func(cfg *ServerConfig) {
+				cfg.APQCache = cache
+			})
+			const query = "query Hello {\n  hello\n}"
+
+			if code := doPersisted(t, s, query, false).errorCode(); code != "PERSISTED_QUERY_NOT_FOUND" {
+				t.Fatalf("unknown hash: error code %q, want PERSISTED_QUERY_NOT_FOUND", code)
+			}
+			// The link falls back to sending the query, which registers it
+			if result := doPersisted(t, s, query, true); len(result.Errors) > 0 {
+				t.Fatal(result.Errors)
+			}
+			result := doPersisted(t, s, query, false)
+			if len(result.Errors) > 0 || string(result.Data) != `{"hello":"Hello, World!"}` {
+				t.Errorf("known hash: %s %v", result.Data, result.Errors)
+			}
+		})
+	}
+}
+
+func TestPersistedQueriesOnly(t *testing.T) {
+	const allowed = "query Hello {\n  hello\n}"
+	manifest, _ := json.Marshal(map[string]string{queryHash(allowed): allowed})
+	path := filepath.Join(t.TempDir(), "persisted-queries.json")
+	if err := os.WriteFile(path, manifest, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.PersistedQueriesOnly = true
+		cfg.PersistedQueriesManifest = path
+	})
+
+	for _, includeQuery := range []bool{false, true} {
+		if result := doPersisted(t, s, allowed, includeQuery); len(result.Errors) > 0 {
+			t.Errorf("includeQuery %v: %v", includeQuery, result.Errors)
+		}
+	}
+	if code := doPersisted(t, s, "{ users }", true).errorCode(); code != "OPERATION_NOT_ALLOWED" {
+		t.Errorf("unlisted query: error code %q, want OPERATION_NOT_ALLOWED", code)
+	}
+
+	tampered, _ := json.Marshal(map[string]string{queryHash(allowed): "{ users }"})
+	if err := os.WriteFile(path, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPersistedQueries(path); err == nil {
+		t.Error("loaded a manifest with a wrong hash")
+	}
+}
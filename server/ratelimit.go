@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/go-redis/redis/v8"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Limit is a token bucket that holds up to Burst tokens and refills Rate
+// tokens per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter takes one token from the bucket identified by key
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// MemoryRateLimiter keeps buckets in process memory, suitable for a single instance
+type MemoryRateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Drop buckets that have been full for a while so the map doesn't grow forever
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > 10*time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait, nil
+}
+
+// RedisRateLimiter shares buckets between instances through Redis
+type RedisRateLimiter struct {
+	redis *redis.Client
+}
+
+func NewRedisRateLimiter(redisClient *redis.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{redis: redisClient}
+}
+
+// tokenBucketScript refills and takes a token atomically. Times are in milliseconds.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate) + 1000)
+return {allowed, wait}
+`)
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	perMillisecond := limit.Rate / 1000
+	result, err := tokenBucketScript.Run(ctx, l.redis, []string{"ratelimit:" + key},
+		perMillisecond, limit.Burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// RateLimitConfig configures the RateLimit extension
+type RateLimitConfig struct {
+	// Fields maps root field names (e.g. "postMessage") to their limit
+	Fields map[string]Limit
+	// DefaultMutation applies to mutations without an entry in Fields
+	DefaultMutation Limit
+	// MaxSubscriptionsPerUser caps concurrent subscriptions per user or IP
+	MaxSubscriptionsPerUser int
+}
+
+// DefaultRateLimitConfig returns limits that are generous for people but stop scripts
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Fields: map[string]Limit{
+			"postMessage": {Rate: 1, Burst: 10},
+		},
+		DefaultMutation:         Limit{Rate: 2, Burst: 20},
+		MaxSubscriptionsPerUser: 10,
+	}
+}
+
+// parseLimit parses "count/period" where period is s, m or h
+func parseLimit(value string) (Limit, error) {
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("expected count/period")
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid count %q", count)
+	}
+
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid period %q", period)
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// RateLimit is a gqlgen extension that rate limits root fields per client and
+// caps the number of concurrent subscriptions
+type RateLimit struct {
+	limiter RateLimiter
+	config  RateLimitConfig
+
+	mutex         sync.Mutex
+	subscriptions map[string]int
+}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+	graphql.OperationInterceptor
+} = &RateLimit{}
+
+func NewRateLimit(limiter RateLimiter, config RateLimitConfig) *RateLimit {
+	return &RateLimit{
+		limiter:       limiter,
+		config:        config,
+		subscriptions: make(map[string]int),
+	}
+}
+
+func (r *RateLimit) ExtensionName() string {
+	return "RateLimit"
+}
+
+func (r *RateLimit) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (r *RateLimit) limitFor(op ast.Operation, field string) (Limit, bool) {
+	if limit, ok := r.config.Fields[field]; ok {
+		return limit, true
+	}
+	if op == ast.Mutation && r.config.DefaultMutation.Rate > 0 {
+		return r.config.DefaultMutation, true
+	}
+	return Limit{}, false
+}
+
+// MutateOperationContext takes a token for every limited root field before
+// the operation runs. Collecting the fields counts those in fragments too.
+func (r *RateLimit) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	if rc.Operation == nil {
+		return nil
+	}
+	for _, field := range graphql.CollectFields(rc, rc.Operation.SelectionSet, nil) {
+		if err := r.Allow(ctx, rc.Operation.Operation, field.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Allow takes a token for a root field of the given operation type. The REST
+// API calls it for the field its endpoint corresponds to, so both APIs share
+// the same limits.
+func (r *RateLimit) Allow(ctx context.Context, op ast.Operation, field string) *gqlerror.Error {
+	limit, ok := r.limitFor(op, field)
+	if !ok {
+		return nil
+	}
+
+	allowed, retryAfter, err := r.limiter.Allow(ctx, field+":"+ClientFromContext(ctx).Key(), limit)
+	if err != nil {
+		// Fail open, a Redis hiccup shouldn't take the chat down
+		return nil
+	}
+	if !allowed {
+		return rateLimitedError(fmt.Sprintf("too many %s requests, try again later", field), retryAfter)
+	}
+	return nil
+}
+
+// InterceptOperation tracks open subscriptions per client
+func (r *RateLimit) InterceptOperation(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	rc := graphql.GetOperationContext(ctx)
+	if r.config.MaxSubscriptionsPerUser <= 0 || rc.Operation == nil || rc.Operation.Operation != ast.Subscription {
+		return next(ctx)
+	}
+
+	key := ClientFromContext(ctx).Key()
+
+	r.mutex.Lock()
+	if r.subscriptions[key] >= r.config.MaxSubscriptionsPerUser {
+		r.mutex.Unlock()
+		return graphql.OneShot(&graphql.Response{Errors: gqlerror.List{
+			rateLimitedError("too many concurrent subscriptions", 0),
+		}})
+	}
+	r.subscriptions[key]++
+	r.mutex.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.subscriptions[key]--; r.subscriptions[key] <= 0 {
+			delete(r.subscriptions, key)
+		}
+	})
+
+	return next(ctx)
+}
+
+func rateLimitedError(message string, retryAfter time.Duration) *gqlerror.Error {
+	extensions := map[string]interface{}{
+		"code": "RATE_LIMITED",
+	}
+	if retryAfter > 0 {
+		extensions["retryAfter"] = math.Ceil(retryAfter.Seconds())
+	}
+	return &gqlerror.Error{Message: message, Extensions: extensions}
+}
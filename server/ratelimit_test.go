@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRateLimitCountsFragments(t *testing.T) {
+	queries := map[string]string{
+		"field": `mutation($user: String!, $text: String!) { postMessage(user: $user, text: $text) { id } }`,
+		"fragment spread": `mutation($user: String!, $text: String!) { ...Post }
+			fragment Post on Mutation { postMessage(user: $user, text: $text) { id } }`,
+		"inline fragment": `mutation($user: String!, $text: String!) { ... on Mutation { postMessage(user: $user, text: $text) { id } } }`,
+		"aliases": `mutation($user: String!, $text: String!) {
+			a: postMessage(user: $user, text: $text) { id }
+			b: postMessage(user: $user, text: $text) { id }
+			c: postMessage(user: $user, text: $text) { id }
+		}`,
+	}
+	for name, query := range queries {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newTestServer(t, func(cfg *ServerConfig) {
+				cfg.RateLimits = "postMessage=2/h"
+			})
+			session := sessionFor(s, "alice")
+
+			var code string
+			for i := 0; i < 3 && code == ""; i++ {
+				text := fmt.Sprintf("%s %d", name, i)
+				result := doGraphQL(t, s, query, map[string]interface{}{"user": "alice", "text": text}, session)
+				code = result.errorCode()
+			}
+			if code != "RATE_LIMITED" {
+				t.Errorf("error code %q after 3 requests, want RATE_LIMITED", code)
+			}
+		})
+	}
+}
+
+func TestRateLimitIgnoresForgedCookies(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.RateLimits = "blockUser=2/h"
+	})
+
+	var code string
+	for _, user := range []string{"mallory1", "mallory2", "mallory3"} {
+		forged := []*http.Cookie{
+			{Name: displayCookie, Value: user},
+			{Name: sessionCookie, Value: user},
+		}
+		result := doGraphQL(t, s, `mutation { blockUser(user: "alice") }`, nil, forged...)
+		code = result.errorCode()
+	}
+	if code != "RATE_LIMITED" {
+		t.Errorf("error code %q, want RATE_LIMITED for the shared IP bucket", code)
+	}
+}
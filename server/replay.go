@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/ksuid"
+)
+
+// maxReplayedMessages bounds how many missed messages a resuming subscriber
+// receives, older ones have to be fetched with the messages query
+const maxReplayedMessages = 100
+
+// newMessageID returns a KSUID greater than every message ID this instance
+// handed out before. KSUIDs only encode the second and are random within it,
+// so IDs from the same second are made to follow each other.
+func (r *Resolver) newMessageID() string {
+	r.idMutex.Lock()
+	defer r.idMutex.Unlock()
+	id := ksuid.New()
+	if ksuid.Compare(id, r.lastMessageID) <= 0 {
+		id = r.lastMessageID.Next()
+	}
+	r.lastMessageID = id
+	return id.String()
+}
+
+// messagesAfter returns up to limit visible messages posted after the
+// message with the given ID. The messages set only orders by second, so
+// messages from the same second are told apart by their IDs, which sort in
+// posting order as strings (see newMessageID).
+func (r *Resolver) messagesAfter(ctx context.Context, id string, limit int) ([]*Message, error) {
+	score, err := r.redis.ZScore(ctx, "messages", id).Result()
+	if err == redis.Nil {
+		// The message was deleted since, start at the time encoded in its ID
+		parsed, perr := ksuid.Parse(id)
+		if perr != nil {
+			return nil, nil
+		}
+		score, err = float64(parsed.Time().Unix()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages from the same second come first and may all be older ones, so
+	// fetch enough to still have limit newer ones after dropping them
+	second := strconv.FormatFloat(score, 'f', -1, 64)
+	sameSecond, err := r.redis.ZCount(ctx, "messages", second, second).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := r.redis.ZRangeByScore(ctx, "messages", &redis.ZRangeBy{
+		Min:   second,
+		Max:   "+inf",
+		Count: int64(limit) + sameSecond,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	ids = slices.DeleteFunc(ids, func(other string) bool { return other <= id })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	messages := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		messageJSON, err := r.redis.Get(ctx, "message:"+id).Result()
+		if err != nil {
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal([]byte(messageJSON), &message); err != nil || message.Hidden {
+			continue
+		}
+		messages = append(messages, &message)
+	}
+	return messages, nil
+}
+
+// withReplay sends the messages user missed since the last received ID
+// before the live ones. Messages that are both replayed and delivered live
+// are only sent once.
+func (r *Resolver) withReplay(ctx context.Context, lastID string, user string, live <-chan *Message) <-chan *Message {
+	missed, err := r.messagesAfter(ctx, lastID, maxReplayedMessages)
+	if err == nil {
+		missed, err = r.filterBlocked(ctx, user, missed)
+	}
+	if err != nil {
+		// Resuming is best effort, the client still gets new messages
+		slog.WarnContext(ctx, "Failed to load missed messages", "last_id", lastID, "error", err)
+		return live
+	}
+	if len(missed) == 0 {
+		return live
+	}
+	slog.DebugContext(ctx, "Replaying missed messages", "last_id", lastID, "count", len(missed))
+
+	out := make(chan *Message, 1)
+	go func() {
+		defer close(out)
+		replayed := make(map[string]bool, len(missed))
+		for _, msg := range missed {
+			replayed[msg.ID] = true
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for msg := range live {
+			if replayed[msg.ID] {
+				continue
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
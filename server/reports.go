@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/ksuid"
+)
+
+// defaultReportHideThreshold is the number of distinct reporters after which
+// a message is hidden until an admin reviews it. Reporters must be logged in
+// with a signed session or an access token, so they can't be made up.
+const defaultReportHideThreshold = 3
+
+// Report is a user's complaint about a message
+type Report struct {
+	ID         string        `json:"id"`
+	MessageID  string        `json:"messageId"`
+	Reporter   string        `json:"reporter"`
+	Reason     string        `json:"reason"`
+	Status     ReportStatus  `json:"status"`
+	CreatedAt  Time          `json:"createdAt"`
+	ResolvedBy *string       `json:"resolvedBy,omitempty"`
+	ResolvedAt *Time         `json:"resolvedAt,omitempty"`
+	Action     *ReportAction `json:"action,omitempty"`
+}
+
+// ModerationLogEntry records an action taken by a moderator
+type ModerationLogEntry struct {
+	ID        string  `json:"id"`
+	Action    string  `json:"action"`
+	Actor     string  `json:"actor"`
+	Target    string  `json:"target"`
+	Detail    *string `json:"detail,omitempty"`
+	CreatedAt Time    `json:"createdAt"`
+}
+
+func reportKey(id string) string {
+	return "report:" + id
+}
+
+func reportStatusKey(status ReportStatus) string {
+	return "reports:" + strings.ToLower(status.String())
+}
+
+func (r *Resolver) reportMessage(ctx context.Context, reporter string, messageID string, reason string) (*Report, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, errors.New("a reason is required")
+	}
+
+	msg, err := r.loadMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.User == reporter {
+		return nil, errors.New("you can't report your own message")
+	}
+
+	// Each user can report a message once
+	added, err := r.redis.SAdd(ctx, "reports:reporters:"+messageID, reporter).Result()
+	if err != nil {
+		return nil, err
+	}
+	if added == 0 {
+		return nil, errors.New("you already reported this message")
+	}
+
+	report := &Report{
+		ID:        ksuid.New().String(),
+		MessageID: messageID,
+		Reporter:  reporter,
+		Reason:    reason,
+		Status:    ReportStatusOpen,
+		CreatedAt: Time{Time: time.Now()},
+	}
+	if err := r.saveReport(ctx, report); err != nil {
+		return nil, err
+	}
+
+	reporters, err := r.redis.SCard(ctx, "reports:reporters:"+messageID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if int(reporters) >= r.config.ReportHideThreshold && !msg.Hidden {
+		if err := r.hideMessage(ctx, msg); err != nil {
+			return nil, err
+		}
+		r.logModeration(ctx, "system", "AUTO_HIDE", messageID, fmt.Sprintf("%d reports", reporters))
+	}
+
+	return report, nil
+}
+
+func (r *Resolver) saveReport(ctx context.Context, report *Report) error {
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.redis.TxPipeline()
+	pipe.Set(ctx, reportKey(report.ID), reportJSON, 0)
+	for _, status := range AllReportStatus {
+		if status != report.Status {
+			pipe.ZRem(ctx, reportStatusKey(status), report.ID)
+		}
+	}
+	pipe.ZAdd(ctx, reportStatusKey(report.Status), &redis.Z{
+		Score:  float64(report.CreatedAt.Unix()),
+		Member: report.ID,
+	})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *Resolver) loadReport(ctx context.Context, id string) (*Report, error) {
+	reportJSON, err := r.redis.Get(ctx, reportKey(id)).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("report %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var report Report
+	if err := json.Unmarshal([]byte(reportJSON), &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// reports returns the reports with the given status, oldest first
+func (r *Resolver) reports(ctx context.Context, status ReportStatus) ([]*Report, error) {
+	ids, err := r.redis.ZRange(ctx, reportStatusKey(status), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []*Report{}
+	for _, id := range ids {
+		report, err := r.loadReport(ctx, id)
+		if err != nil {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// resolveReport applies an admin's decision to a report
+func (r *Resolver) resolveReport(ctx context.Context, id string, action ReportAction) (*Report, error) {
+	actor := ClientFromContext(ctx).User
+
+	report, err := r.loadReport(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if report.Status != ReportStatusOpen {
+		return nil, fmt.Errorf("report %s is already %s", id, strings.ToLower(report.Status.String()))
+	}
+
+	msg, err := r.loadMessage(ctx, report.MessageID)
+	if err != nil && action != ReportActionDismiss {
+		return nil, err
+	}
+
+	switch action {
+	case ReportActionDismiss:
+		report.Status = ReportStatusDismissed
+	case ReportActionHideMessage:
+		if !msg.Hidden {
+			if err := r.hideMessage(ctx, msg); err != nil {
+				return nil, err
+			}
+		}
+		report.Status = ReportStatusResolved
+	case ReportActionDeleteMessage:
+		if err := r.deleteMessage(ctx, msg); err != nil {
+			return nil, err
+		}
+		report.Status = ReportStatusResolved
+	case ReportActionBanAuthor:
+		if err := r.checkModerationTarget(ctx, msg.User); err != nil {
+			return nil, err
+		}
+		if err := r.banUser(ctx, msg.User); err != nil {
+			return nil, err
+		}
+		report.Status = ReportStatusResolved
+	}
+
+	now := Time{Time: time.Now()}
+	report.ResolvedBy = &actor
+	report.ResolvedAt = &now
+	report.Action = &action
+	if err := r.saveReport(ctx, report); err != nil {
+		return nil, err
+	}
+
+	r.logModeration(ctx, actor, action.String(), report.MessageID, "report "+report.ID)
+	return report, nil
+}
+
+// hideMessage marks a message as hidden and tells subscribers about it
+// without repeating its content
+func (r *Resolver) hideMessage(ctx context.Context, msg *Message) error {
+	if _, err := r.updateMessage(ctx, msg.ID, func(stored *Message) {
+		stored.Hidden = true
+	}); err != nil {
+		return err
+	}
+	msg.Hidden = true
+	r.broadcastUpdate(ctx, redactedMessage(msg))
+	return nil
+}
+
+// deleteMessage removes a message and its attachments for good and closes
+// its open reports.
+// Subscribers are sent a hidden, empty copy so clients drop it from their
+// view.
+func (r *Resolver) deleteMessage(ctx context.Context, msg *Message) error {
+	pipe := r.redis.TxPipeline()
+	pipe.Del(ctx, "message:"+msg.ID)
+	pipe.ZRem(ctx, "messages", msg.ID)
+	pipe.ZRem(ctx, "moderation:queue", msg.ID)
+	pipe.Del(ctx, "reports:reporters:"+msg.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	r.deleteAttachments(ctx, msg.Attachments)
+
+	if err := r.closeReports(ctx, msg.ID); err != nil {
+		slog.ErrorContext(ctx, "Failed to close the reports of a deleted message", "message", msg.ID, "error", err)
+	}
+	r.broadcastUpdate(ctx, redactedMessage(msg))
+	return nil
+}
+
+// redactedMessage returns a hidden copy of msg without its content
+func redactedMessage(msg *Message) *Message {
+	return &Message{ID: msg.ID, User: msg.User, CreatedAt: msg.CreatedAt, Hidden: true}
+}
+
+// closeReports resolves the open reports of a deleted message, since there
+// is nothing left to review
+func (r *Resolver) closeReports(ctx context.Context, messageID string) error {
+	reports, err := r.reports(ctx, ReportStatusOpen)
+	if err != nil {
+		return err
+	}
+
+	actor := ClientFromContext(ctx).User
+	action := ReportActionDeleteMessage
+	now := Time{Time: time.Now()}
+	for _, report := range reports {
+		if report.MessageID != messageID {
+			continue
+		}
+		report.Status = ReportStatusResolved
+		report.ResolvedBy = &actor
+		report.ResolvedAt = &now
+		report.Action = &action
+		if err := r.saveReport(ctx, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logModeration appends an entry to the moderation trail and the audit log
+func (r *Resolver) logModeration(ctx context.Context, actor, action, target, detail string) {
+	r.audit.Record(ctx, action, actor, target, detail)
+
+	entry := &ModerationLogEntry{
+		ID:        ksuid.New().String(),
+		Action:    action,
+		Actor:     actor,
+		Target:    target,
+		CreatedAt: Time{Time: time.Now()},
+	}
+	if detail != "" {
+		entry.Detail = &detail
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	r.redis.LPush(ctx, "moderation:log", entryJSON)
+}
+
+// moderationLog returns the most recent moderation actions, newest first
+func (r *Resolver) moderationLog(ctx context.Context, first int) ([]*ModerationLogEntry, error) {
+	first = min(max(first, 1), maxListSize)
+	entries, err := r.redis.LRange(ctx, "moderation:log", 0, int64(first)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	log := make([]*ModerationLogEntry, 0, len(entries))
+	for _, entryJSON := range entries {
+		var entry ModerationLogEntry
+		if err := json.Unmarshal([]byte(entryJSON), &entry); err != nil {
+			continue
+		}
+		log = append(log, &entry)
+	}
+	return log, nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const reportMutation = `mutation($id: ID!) { reportMessage(id: $id, reason: "spam") { id } }`
+
+func TestAutoHideBroadcastsRedactedMessage(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	id := postTestMessage(t, s, "alice", "something secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := s.resolver.subscribe(ctx, "updated", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Forged cookies don't count as reporters
+	for _, user := range []string{"mallory1", "mallory2", "mallory3"} {
+		forged := &http.Cookie{Name: sessionCookie, Value: user + ".9999999999.forged"}
+		result := doGraphQL(t, s, reportMutation, map[string]interface{}{"id": id}, forged)
+		if code := result.errorCode(); code != "FORBIDDEN" {
+			t.Fatalf("report with a forged session: code %q", code)
+		}
+	}
+	msg, err := s.resolver.loadMessage(ctx, id)
+	if err != nil || msg.Hidden {
+		t.Fatalf("message hidden by forged reports: %+v, %v", msg, err)
+	}
+
+	for _, user := range []string{"bob", "carol", "dave"} {
+		result := doGraphQL(t, s, reportMutation, map[string]interface{}{"id": id}, sessionFor(s, user))
+		if len(result.Errors) > 0 {
+			t.Fatalf("report by %s: %+v", user, result.Errors)
+		}
+	}
+
+	select {
+	case update := <-updates:
+		if update.ID != id || !update.Hidden || update.Text != "" {
+			t.Errorf("broadcast %+v, want a hidden message without text", update)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no update was broadcast")
+	}
+
+	msg, err = s.resolver.loadMessage(ctx, id)
+	if err != nil || !msg.Hidden || msg.Text != "something secret" {
+		t.Errorf("stored message %+v, %v, want hidden with its text", msg, err)
+	}
+}
+
+func TestDeleteMessageClosesReports(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.OwnerUsers = []string{"owner"}
+	})
+	id := postTestMessage(t, s, "alice", "report me")
+	other := postTestMessage(t, s, "alice", "leave me")
+
+	reports := []struct{ user, id string }{{"bob", id}, {"carol", id}, {"bob", other}}
+	for _, report := range reports {
+		result := doGraphQL(t, s, reportMutation, map[string]interface{}{"id": report.id}, sessionFor(s, report.user))
+		if len(result.Errors) > 0 {
+			t.Fatalf("report: %+v", result.Errors)
+		}
+	}
+
+	ctx := context.Background()
+	open, err := s.resolver.reports(ctx, ReportStatusOpen)
+	if err != nil || len(open) != 3 {
+		t.Fatalf("%d open reports, %v", len(open), err)
+	}
+	var first string
+	for _, report := range open {
+		if report.MessageID == id {
+			first = report.ID
+			break
+		}
+	}
+
+	result := doGraphQL(t, s, `mutation($id: ID!) { resolveReport(id: $id, action: DELETE_MESSAGE) { status } }`,
+		map[string]interface{}{"id": first}, sessionFor(s, "owner"))
+	if len(result.Errors) > 0 {
+		t.Fatalf("resolveReport: %+v", result.Errors)
+	}
+
+	open, err = s.resolver.reports(ctx, ReportStatusOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 1 || open[0].MessageID != other {
+		t.Errorf("open reports %+v, want only the one of the other message", open)
+	}
+	resolved, err := s.resolver.reports(ctx, ReportStatusResolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, report := range resolved {
+		if report.Action == nil || *report.Action != ReportActionDeleteMessage || report.ResolvedBy == nil || *report.ResolvedBy != "owner" {
+			t.Errorf("resolved report %+v", report)
+		}
+	}
+	if len(resolved) != 2 {
+		t.Errorf("%d resolved reports, want 2", len(resolved))
+	}
+}
@@ -3,12 +3,18 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/go-redis/redis/v8"
 	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // This file will not be regenerated automatically.
@@ -16,62 +22,313 @@ import (
 // It serves as dependency injection for your app, add any dependencies you require here.
 
 type Resolver struct {
+	config      *ServerConfig
 	redis       *redis.Client
+	blobs       BlobStore
+	unfurler    *Unfurler
+	moderator   *Moderator
+	audit       *AuditLog
+	webhooks    *Webhooks
 	mutex       sync.RWMutex
-	subscribers map[string][]chan *Message
+	subscribers map[string][]*subscription
+	// blocked mirrors the block lists of users with active subscriptions
+	blocked map[string]map[string]bool
+	// closing is set once the server shuts down and no longer accepts subscriptions
+	closing bool
+	// cleanups tracks subscriptions whose channel hasn't been closed yet
+	cleanups sync.WaitGroup
+	// idMutex guards lastMessageID, the latest ID handed out by newMessageID
+	idMutex       sync.Mutex
+	lastMessageID ksuid.KSUID
 }
 
-func NewResolver(redisClient *redis.Client) *Resolver {
+// subscription is a channel of a single subscriber to a topic
+type subscription struct {
+	ch     chan delivery
+	user   string
+	cancel context.CancelFunc
+	// token is the ID of the access token the subscription was opened with
+	token string
+}
+
+// delivery is a message on its way to a subscriber. It carries the span of
+// the broadcast so the hand-off to the subscriber joins the publisher's trace.
+type delivery struct {
+	message *Message
+	span    trace.SpanContext
+}
+
+func NewResolver(cfg *ServerConfig, redisClient *redis.Client) *Resolver {
 	return &Resolver{
+		config:      cfg,
 		redis:       redisClient,
-		subscribers: make(map[string][]chan *Message),
+		subscribers: make(map[string][]*subscription),
 	}
 }
 
 // Helper method to broadcast messages
-func (r *Resolver) broadcastMessage(message *Message) {
-	r.mutex.RLock()
-	log.Printf("[DEBUG] Starting broadcast for message ID: %s", message.ID)
-	log.Printf("[DEBUG] Current subscribers count: %d", len(r.subscribers))
+func (r *Resolver) broadcastMessage(ctx context.Context, message *Message) {
+	slog.DebugContext(ctx, "Starting broadcast", "message", message.ID)
+	r.publish(ctx, "broadcast", message)
+	slog.DebugContext(ctx, "Broadcast complete", "message", message.ID)
+	r.webhooks.Publish(ctx, WebhookEventMessagePosted, defaultRoom, map[string]*Message{"message": withoutModeration(message)})
+}
 
-	// Take a snapshot of channels
-	var channels []chan *Message
-	for _, userChannels := range r.subscribers {
-		channels = append(channels, userChannels...)
-	}
-	r.mutex.RUnlock()
+// broadcastUpdate notifies messageUpdated subscribers about a changed message
+func (r *Resolver) broadcastUpdate(ctx context.Context, message *Message) {
+	slog.DebugContext(ctx, "Broadcasting update", "message", message.ID)
+	r.publish(ctx, "updated", message)
+	r.webhooks.Publish(ctx, WebhookEventMessageUpdated, defaultRoom, map[string]*Message{"message": withoutModeration(message)})
+}
 
-	log.Printf("[DEBUG] Broadcasting to %d channels", len(channels))
+// withoutModeration returns a copy of message without its moderation, which
+// only admins may see. Webhook receivers are other services, not admins.
+func withoutModeration(message *Message) *Message {
+	copied := *message
+	copied.Moderation = nil
+	return &copied
+}
+
+// publish sends a message to every channel subscribed to topic, skipping
+// subscribers who blocked the author
+func (r *Resolver) publish(ctx context.Context, topic string, message *Message) {
+	_, span := tracer.Start(ctx, "broadcast "+topic, trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	// Hold the read lock while sending so cleanup can't close a channel
+	// mid-broadcast. Sends never block, so this is cheap.
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	subs := r.subscribers[topic]
+	slog.Debug("Broadcasting", "topic", topic, "channels", len(subs))
 
 	// Broadcast to all channels
-	for _, ch := range channels {
+	delivered := 0
+	for _, sub := range subs {
+		if r.blocked[sub.user][message.User] {
+			continue
+		}
 		select {
-		case ch <- message:
-			log.Printf("[DEBUG] Successfully sent message ID: %s to a channel", message.ID)
+		case sub.ch <- delivery{message: message, span: span.SpanContext()}:
+			delivered++
 		default:
-			log.Printf("[DEBUG] Failed to send message to channel (blocked or closed)")
+			broadcastDropped.WithLabelValues(topic).Inc()
+			slog.Warn("Dropped message for a slow subscriber", "topic", topic, "message", message.ID, "user", sub.user)
+		}
+	}
+	broadcastFanout.WithLabelValues(topic).Observe(float64(delivered))
+	span.SetAttributes(
+		attribute.Int("chat.subscribers", len(subs)),
+		attribute.Int("chat.delivered", delivered),
+	)
+}
+
+// subscribe registers a channel for topic that is removed once ctx is done
+// or the user is disconnected
+func (r *Resolver) subscribe(ctx context.Context, topic string, user string) (<-chan *Message, error) {
+	blocked, err := r.blockedUsers(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	if r.closing {
+		r.mutex.Unlock()
+		return nil, errors.New("server is shutting down")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &subscription{
+		// Create buffered channel
+		ch:     make(chan delivery, 100),
+		user:   user,
+		cancel: cancel,
+	}
+	if token := ClientFromContext(ctx).Token; token != nil {
+		sub.token = token.ID
+	}
+
+	// Initialize subscribers map if needed
+	if r.subscribers == nil {
+		r.subscribers = make(map[string][]*subscription)
+	}
+	if r.blocked == nil {
+		r.blocked = make(map[string]map[string]bool)
+	}
+
+	// Add channel to subscribers
+	r.subscribers[topic] = append(r.subscribers[topic], sub)
+	currentCount := len(r.subscribers[topic])
+	activeSubscriptions.WithLabelValues(topic).Inc()
+
+	if _, ok := r.blocked[user]; !ok {
+		r.blocked[user] = make(map[string]bool, len(blocked))
+		for _, b := range blocked {
+			r.blocked[user][b] = true
+		}
+	}
+	r.mutex.Unlock()
+
+	slog.DebugContext(ctx, "Added subscription", "topic", topic, "channels", currentCount)
+
+	// Handle cleanup when context is done
+	r.cleanups.Add(1)
+	go func() {
+		defer r.cleanups.Done()
+		<-ctx.Done()
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.cleanupChannel(topic, sub)
+
+		if !r.hasSubscriptions(user) {
+			delete(r.blocked, user)
+		}
+	}()
+
+	return deliver(ctx, topic, sub.ch), nil
+}
+
+// deliver hands messages over to gqlgen, tracing each hand-off as a child
+// of the broadcast that sent it. The returned channel is closed after ch.
+func deliver(ctx context.Context, topic string, ch <-chan delivery) <-chan *Message {
+	out := make(chan *Message)
+	go func() {
+		defer close(out)
+		for d := range ch {
+			_, span := tracer.Start(trace.ContextWithRemoteSpanContext(ctx, d.span), "deliver "+topic,
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(attribute.String("chat.message.id", d.message.ID)),
+			)
+			select {
+			case out <- d.message:
+			case <-ctx.Done():
+			}
+			span.End()
+		}
+	}()
+	return out
+}
+
+// closeSubscriptions completes every active subscription, rejects new ones
+// and waits until all channels are closed. It returns how many were closed.
+func (r *Resolver) closeSubscriptions() int {
+	r.mutex.Lock()
+	r.closing = true
+	n := 0
+	for _, subs := range r.subscribers {
+		for _, sub := range subs {
+			sub.cancel()
+			n++
 		}
 	}
-	log.Printf("[DEBUG] Broadcast complete for message ID: %s", message.ID)
+	r.mutex.Unlock()
+
+	r.cleanups.Wait()
+	return n
+}
+
+// isClosing reports whether closeSubscriptions was called
+func (r *Resolver) isClosing() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closing
 }
 
 // Add a helper method for channel cleanup
-func (r *Resolver) cleanupChannel(user string, ch chan *Message) {
-	if channels, exists := r.subscribers[user]; exists {
-		for i, c := range channels {
-			if c == ch {
-				r.subscribers[user] = append(channels[:i], channels[i+1:]...)
-				if len(r.subscribers[user]) == 0 {
-					delete(r.subscribers, user)
+func (r *Resolver) cleanupChannel(topic string, sub *subscription) {
+	if subs, exists := r.subscribers[topic]; exists {
+		for i, s := range subs {
+			if s == sub {
+				r.subscribers[topic] = append(subs[:i], subs[i+1:]...)
+				if len(r.subscribers[topic]) == 0 {
+					delete(r.subscribers, topic)
 				}
-				close(ch)
-				log.Printf("[DEBUG] Cleaned up channel for user: %s", user)
+				close(sub.ch)
+				activeSubscriptions.WithLabelValues(topic).Dec()
+				slog.Debug("Cleaned up subscription", "topic", topic, "user", sub.user)
 				break
 			}
 		}
 	}
 }
 
+// hasSubscriptions reports whether a user has any subscription left. The
+// caller must hold the mutex.
+func (r *Resolver) hasSubscriptions(user string) bool {
+	for _, subs := range r.subscribers {
+		for _, sub := range subs {
+			if sub.user == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadMessage reads a stored message by ID
+func (r *Resolver) loadMessage(ctx context.Context, id string) (*Message, error) {
+	messageJSON, err := r.redis.Get(ctx, "message:"+id).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: %s", errMessageNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var message Message
+	if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// maxUpdateAttempts bounds how often updateMessage retries after the message
+// was written concurrently
+const maxUpdateAttempts = 5
+
+// updateMessage applies change to the stored message and saves it, unless
+// the message was written in the meantime, in which case it starts over
+// with the new version. It returns errMessageNotFound if the message was
+// deleted.
+func (r *Resolver) updateMessage(ctx context.Context, id string, change func(*Message)) (*Message, error) {
+	key := "message:" + id
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var msg Message
+		err := r.redis.Watch(ctx, func(tx *redis.Tx) error {
+			messageJSON, err := tx.Get(ctx, key).Bytes()
+			if err == redis.Nil {
+				return errMessageNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(messageJSON, &msg); err != nil {
+				return err
+			}
+
+			change(&msg)
+			if messageJSON, err = json.Marshal(&msg); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, messageJSON, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+	return nil, fmt.Errorf("message %s kept changing: %w", id, redis.TxFailedErr)
+}
+
 // Query returns QueryResolver implementation.
 func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
 
@@ -85,29 +342,27 @@ type queryResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
 type subscriptionResolver struct{ *Resolver }
 
-func (r *queryResolver) Messages(ctx context.Context) ([]*Message, error) {
-	messages := []*Message{}
-
-	// Clear any wrong type data (temporary fix)
-	r.redis.Del(ctx, "messages")
-
-	// Get message IDs from sorted set
-	messageIDs, err := r.redis.ZRange(ctx, "messages", 0, -1).Result()
-	if err != nil {
-		if err != redis.Nil {
-			return nil, err
-		}
-		// Return empty array if no messages
-		return messages, nil
+func (r *queryResolver) Messages(ctx context.Context, first *int) ([]*Message, error) {
+	// Get the most recent message IDs from the sorted set, as many as the
+	// complexity of the query was calculated for
+	start := -int64(listMultiplier(first))
+	messageIDs, err := r.redis.ZRange(ctx, "messages", start, -1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
+	return r.visibleMessages(ctx, messageIDs)
+}
+
+// visibleMessages loads messages by ID, leaving out missing ones, hidden ones
+// unless the caller is an admin and those of users the caller blocked
+func (r *Resolver) visibleMessages(ctx context.Context, messageIDs []string) ([]*Message, error) {
+	messages := []*Message{}
+	showHidden := r.hasRole(ctx, RoleAdmin) == nil
 
 	// Get each message
 	for _, id := range messageIDs {
 		messageJSON, err := r.redis.Get(ctx, "message:"+id).Result()
 		if err != nil {
-			if err != redis.Nil {
-				continue
-			}
 			continue
 		}
 
@@ -116,10 +371,114 @@ func (r *queryResolver) Messages(ctx context.Context) ([]*Message, error) {
 			continue
 		}
 
+		// Hidden messages stay visible to admins reviewing reports
+		if message.Hidden && !showHidden {
+			continue
+		}
+
 		messages = append(messages, &message)
 	}
 
-	return messages, nil
+	return r.filterBlocked(ctx, ClientFromContext(ctx).User, messages)
+}
+
+var errMessageNotFound = errors.New("message not found")
+
+// messagePage returns up to limit messages posted before the message with ID
+// before, or the latest ones if before is empty, oldest first. cursor is the
+// ID to pass as before for the next page, empty if there are no older
+// messages. It's the oldest message in the range rather than in messages, as
+// hidden and blocked messages are left out.
+func (r *Resolver) messagePage(ctx context.Context, limit int, before string) (messages []*Message, cursor string, err error) {
+	end := int64(-1)
+	if before != "" {
+		rank, err := r.redis.ZRank(ctx, "messages", before).Result()
+		if err == redis.Nil {
+			return nil, "", errMessageNotFound
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		end = rank - 1
+	} else {
+		count, err := r.redis.ZCard(ctx, "messages").Result()
+		if err != nil {
+			return nil, "", err
+		}
+		end = count - 1
+	}
+	if end < 0 {
+		return []*Message{}, "", nil
+	}
+
+	start := max(end-int64(limit)+1, 0)
+	messageIDs, err := r.redis.ZRange(ctx, "messages", start, end).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if start > 0 {
+		cursor = messageIDs[0]
+	}
+	messages, err = r.visibleMessages(ctx, messageIDs)
+	return messages, cursor, err
+}
+
+func (r *queryResolver) BlockedUsers(ctx context.Context) ([]string, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := r.blockedUsers(ctx, user)
+	if blocked == nil {
+		blocked = []string{}
+	}
+	return blocked, err
+}
+
+func (r *queryResolver) AccessTokens(ctx context.Context, user *string) ([]*AccessToken, error) {
+	owner, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && *user != owner {
+		if err := r.hasRole(ctx, RoleAdmin); err != nil {
+			return nil, err
+		}
+		owner = *user
+	}
+	return r.accessTokens(ctx, owner)
+}
+
+func (r *queryResolver) Bots(ctx context.Context) ([]string, error) {
+	return r.bots(ctx)
+}
+
+func (r *queryResolver) Webhooks(ctx context.Context) ([]*Webhook, error) {
+	return r.webhooks.List(ctx)
+}
+
+func (r *queryResolver) WebhookDeliveries(ctx context.Context, id string, first int) ([]*WebhookDelivery, error) {
+	return r.webhooks.Deliveries(ctx, id, first)
+}
+
+func (r *queryResolver) ModerationQueue(ctx context.Context) ([]*Message, error) {
+	return r.moderationQueue(ctx)
+}
+
+func (r *queryResolver) Reports(ctx context.Context, status ReportStatus) ([]*Report, error) {
+	return r.reports(ctx, status)
+}
+
+func (r *queryResolver) ModerationLog(ctx context.Context, first int) ([]*ModerationLogEntry, error) {
+	return r.moderationLog(ctx, first)
+}
+
+func (r *queryResolver) AuditLog(ctx context.Context, filter *AuditLogFilter, first int, after *string) (*AuditLogConnection, error) {
+	return r.audit.Query(ctx, filter, first, after)
+}
+
+func (r *queryResolver) Role(ctx context.Context, user string) (Role, error) {
+	return r.roleOf(ctx, user)
 }
 
 func (r *queryResolver) Users(ctx context.Context) ([]string, error) {
@@ -130,23 +489,58 @@ func (r *queryResolver) Hello(ctx context.Context) (string, error) {
 	return "Hello, World!", nil
 }
 
-func (r *mutationResolver) PostMessage(ctx context.Context, user string, text string) (*Message, error) {
+func (r *mutationResolver) PostMessage(ctx context.Context, user string, text string, attachments []*graphql.Upload) (*Message, error) {
+	// Messages are always posted as the caller, user only guards against a
+	// client that lost track of who is logged in
+	current, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if user != current {
+		return nil, forbiddenError("you can only post as " + current)
+	}
+	client := ClientFromContext(ctx)
+	if err := r.checkCanPost(ctx, user); err != nil {
+		return nil, err
+	}
+
+	id := r.newMessageID()
+	saved, err := r.saveAttachments(ctx, id, attachments)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing refers to the attachments of a message that isn't posted
+	posted := false
+	defer func() {
+		if !posted {
+			r.deleteAttachments(ctx, saved)
+		}
+	}()
+
 	msg := &Message{
-		ID:        ksuid.New().String(),
-		User:      user,
-		Text:      text,
-		CreatedAt: Time{Time: time.Now()},
+		ID:          id,
+		User:        user,
+		Text:        text,
+		CreatedAt:   Time{Time: time.Now()},
+		Attachments: saved,
+		IsBot:       client.IsBot(),
+	}
+
+	if r.moderator != nil {
+		if err := r.moderator.Moderate(ctx, msg); err != nil {
+			return nil, err
+		}
 	}
 
 	// Save to Redis
 	messageJSON, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("[ERROR] Failed to marshal message: %v", err)
+		slog.ErrorContext(ctx, "Failed to marshal message", "error", err)
 		return nil, err
 	}
 
 	if err := r.redis.Set(ctx, "message:"+msg.ID, messageJSON, 0).Err(); err != nil {
-		log.Printf("[ERROR] Failed to save message to Redis: %v", err)
+		slog.ErrorContext(ctx, "Failed to save message to Redis", "error", err)
 		return nil, err
 	}
 
@@ -155,61 +549,244 @@ func (r *mutationResolver) PostMessage(ctx context.Context, user string, text st
 		Score:  score,
 		Member: msg.ID,
 	}).Err(); err != nil {
-		log.Printf("[ERROR] Failed to add message to sorted set: %v", err)
+		slog.ErrorContext(ctx, "Failed to add message to sorted set", "error", err)
 		return nil, err
 	}
+	posted = true
+
+	if r.moderator != nil {
+		if err := r.moderator.Enqueue(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Failed to add message to moderation queue", "error", err)
+		}
+		if err := r.moderator.Record(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Failed to record message for moderation", "error", err)
+		}
+	}
 
-	log.Printf("[DEBUG] Message created - ID: %s, User: %s, Text: %s", msg.ID, msg.User, msg.Text)
+	slog.DebugContext(ctx, "Message created", "message", msg.ID, "author", msg.User, "text", msg.Text)
 
 	// Broadcast in the same goroutine
-	r.broadcastMessage(msg)
+	messagesPosted.Inc()
+	r.broadcastMessage(ctx, msg)
+
+	// Link previews are fetched in the background and sent as an update
+	go r.unfurlMessage(context.WithoutCancel(ctx), msg)
 
 	return msg, nil
 }
 
-func (r *subscriptionResolver) MessagePosted(ctx context.Context, user string) (<-chan *Message, error) {
-	log.Printf("[DEBUG] New subscription request from user: %s", user)
+func (r *mutationResolver) BlockUser(ctx context.Context, user string) (bool, error) {
+	current, err := currentUser(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err := r.blockUser(ctx, current, user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	// Create buffered channel
-	ch := make(chan *Message, 100)
+func (r *mutationResolver) UnblockUser(ctx context.Context, user string) (bool, error) {
+	current, err := currentUser(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err := r.unblockUser(ctx, current, user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	r.mutex.Lock()
-	// Initialize subscribers map if needed
-	if r.subscribers == nil {
-		r.subscribers = make(map[string][]chan *Message)
+func (r *mutationResolver) ReportMessage(ctx context.Context, id string, reason string) (*Report, error) {
+	reporter, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return r.reportMessage(ctx, reporter, id, reason)
+}
 
-	// Add channel to subscribers
-	r.subscribers["broadcast"] = append(r.subscribers["broadcast"], ch)
-	currentCount := len(r.subscribers["broadcast"])
-	r.mutex.Unlock()
+func (r *mutationResolver) ResolveReport(ctx context.Context, id string, action ReportAction) (*Report, error) {
+	return r.resolveReport(ctx, id, action)
+}
 
-	log.Printf("[DEBUG] Added subscription channel. Total channels now: %d", currentCount)
+func (r *mutationResolver) ResolveModeration(ctx context.Context, id string, decision ModerationDecision) (bool, error) {
+	if err := r.resolveModeration(ctx, id, decision); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	// Handle cleanup when context is done
-	go func() {
-		<-ctx.Done()
-		log.Printf("[DEBUG] Subscription context done for user: %s", user)
+func (r *mutationResolver) SetRole(ctx context.Context, user string, role Role) (bool, error) {
+	if err := r.setRole(ctx, user, role); err != nil {
+		return false, err
+	}
+	r.logModeration(ctx, ClientFromContext(ctx).User, "SET_ROLE", user, role.String())
+	return true, nil
+}
 
-		r.mutex.Lock()
-		defer r.mutex.Unlock()
+func (r *mutationResolver) BanUser(ctx context.Context, user string) (bool, error) {
+	if err := r.checkModerationTarget(ctx, user); err != nil {
+		return false, err
+	}
+	if err := r.banUser(ctx, user); err != nil {
+		return false, err
+	}
+	r.logModeration(ctx, ClientFromContext(ctx).User, "BAN", user, "")
+	return true, nil
+}
 
-		// Find and remove the channel
-		channels := r.subscribers["broadcast"]
-		for i, c := range channels {
-			if c == ch {
-				// Remove this channel
-				r.subscribers["broadcast"] = append(channels[:i], channels[i+1:]...)
-				close(ch)
-				log.Printf("[DEBUG] Removed subscription channel. Remaining: %d", len(r.subscribers["broadcast"]))
-				break
-			}
+func (r *mutationResolver) UnbanUser(ctx context.Context, user string) (bool, error) {
+	if err := r.unbanUser(ctx, user); err != nil {
+		return false, err
+	}
+	r.logModeration(ctx, ClientFromContext(ctx).User, "UNBAN", user, "")
+	return true, nil
+}
+
+func (r *mutationResolver) MuteUser(ctx context.Context, user string, duration int) (bool, error) {
+	if err := r.checkModerationTarget(ctx, user); err != nil {
+		return false, err
+	}
+	if err := r.muteUser(ctx, user, time.Duration(duration)*time.Second); err != nil {
+		return false, err
+	}
+	r.logModeration(ctx, ClientFromContext(ctx).User, "MUTE", user, fmt.Sprintf("%ds", duration))
+	return true, nil
+}
+
+func (r *mutationResolver) KickUser(ctx context.Context, user string, roomID string) (bool, error) {
+	if err := r.checkModerationTarget(ctx, user); err != nil {
+		return false, err
+	}
+	if err := r.kickUser(ctx, user, roomID); err != nil {
+		return false, err
+	}
+	r.logModeration(ctx, ClientFromContext(ctx).User, "KICK", user, roomID)
+	return true, nil
+}
+
+func (r *mutationResolver) CreateBot(ctx context.Context, name string) (string, error) {
+	return r.createBot(ctx, name)
+}
+
+func (r *mutationResolver) DeleteBot(ctx context.Context, name string) (bool, error) {
+	if err := r.deleteBot(ctx, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *mutationResolver) CreateAccessToken(ctx context.Context, name string, scopes []TokenScope, bot *string) (*NewAccessToken, error) {
+	owner, err := currentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// A leaked token must not be able to mint more of them
+	if ClientFromContext(ctx).Token != nil {
+		return nil, forbiddenError("access tokens can't create access tokens")
+	}
+	if bot != nil {
+		if err := r.hasRole(ctx, RoleAdmin); err != nil {
+			return nil, err
 		}
-	}()
+		ok, err := r.isBot(ctx, *bot)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown bot %q", *bot)
+		}
+		owner = *bot
+	}
+	if slices.Contains(scopes, TokenScopeAdmin) {
+		if err := r.hasRole(ctx, RoleAdmin); err != nil {
+			return nil, err
+		}
+	}
+	return r.createAccessToken(ctx, owner, name, scopes)
+}
 
+func (r *mutationResolver) RevokeAccessToken(ctx context.Context, id string) (bool, error) {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return false, err
+	}
+	token, err := r.accessToken(ctx, id)
+	if err == redis.Nil {
+		return false, fmt.Errorf("unknown access token %q", id)
+	}
+	if err != nil {
+		return false, err
+	}
+	if token.User != user {
+		if err := r.hasRole(ctx, RoleAdmin); err != nil {
+			return false, err
+		}
+	}
+	if err := r.revokeAccessToken(ctx, token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *mutationResolver) CreateWebhook(ctx context.Context, url string, events []WebhookEvent, room *string) (*NewWebhook, error) {
+	created, err := r.webhooks.Create(ctx, url, events, room)
+	if err != nil {
+		return nil, err
+	}
+	r.audit.Record(ctx, "WEBHOOK_CREATED", ClientFromContext(ctx).User, created.Webhook.ID, url)
+	return created, nil
+}
+
+func (r *mutationResolver) DeleteWebhook(ctx context.Context, id string) (bool, error) {
+	if err := r.webhooks.Delete(ctx, id); err != nil {
+		return false, err
+	}
+	r.audit.Record(ctx, "WEBHOOK_DELETED", ClientFromContext(ctx).User, id, "")
+	return true, nil
+}
+
+func (r *mutationResolver) TestWebhook(ctx context.Context, id string) (*WebhookDelivery, error) {
+	hook, err := r.webhooks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return r.webhooks.Test(ctx, hook)
+}
+
+func (r *subscriptionResolver) MessagePosted(ctx context.Context, user string) (<-chan *Message, error) {
+	slog.DebugContext(ctx, "New subscription request", "topic", "broadcast")
+	user = subscriberName(ctx)
+	if err := r.checkNotBanned(ctx, user); err != nil {
+		return nil, err
+	}
+	ch, err := r.subscribe(ctx, "broadcast", user)
+	if err != nil {
+		return nil, err
+	}
+	// SSE clients that reconnect first get what they missed
+	if id := lastEventID(ctx); id != "" {
+		return r.withReplay(ctx, id, user, ch), nil
+	}
 	return ch, nil
 }
 
+func (r *subscriptionResolver) MessageUpdated(ctx context.Context, user string) (<-chan *Message, error) {
+	slog.DebugContext(ctx, "New subscription request", "topic", "updated")
+	user = subscriberName(ctx)
+	if err := r.checkNotBanned(ctx, user); err != nil {
+		return nil, err
+	}
+	return r.subscribe(ctx, "updated", user)
+}
+
+// subscriberName returns the logged in user, or nothing for anonymous
+// subscribers. The name sent by the client is ignored, trusting it would let
+// anyone subscribe with another user's block list and see who they blocked.
+func subscriberName(ctx context.Context) string {
+	return ClientFromContext(ctx).User
+}
+
 func (r *subscriptionResolver) UserJoined(ctx context.Context, user string) (<-chan string, error) {
 	ch := make(chan string, 1)
 	go func() {
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+
+	// restMaxBodySize limits JSON request bodies
+	restMaxBodySize = 64 << 10
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// apiError is the body of every failed REST response, e.g.
+// {"error": {"code": "RATE_LIMITED", "message": "...", "retryAfter": 12}}.
+// Successful responses wrap their result in {"data": ...} instead.
+type apiError struct {
+	Code       string  `json:"code"`
+	Message    string  `json:"message"`
+	Reason     string  `json:"reason,omitempty"`
+	RetryAfter float64 `json:"retryAfter,omitempty"`
+}
+
+// MessagePage is a page of messages, oldest first. NextCursor is passed as
+// before to get the page of older messages.
+type MessagePage struct {
+	Messages   []*Message `json:"messages"`
+	HasMore    bool       `json:"hasMore"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// Me describes the logged in user
+type Me struct {
+	User    string   `json:"user"`
+	Role    Role     `json:"role"`
+	IsBot   bool     `json:"isBot"`
+	Blocked []string `json:"blocked"`
+}
+
+// restAPI routes the versioned REST API. It shares the resolver, roles,
+// moderation and rate limits with the GraphQL API.
+func (s *Server) restAPI() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/messages", s.restMethods(map[string]http.HandlerFunc{
+		http.MethodGet:  s.handleListMessages,
+		http.MethodPost: s.handlePostMessage,
+	}))
+	mux.HandleFunc("/api/v1/users", s.restMethods(map[string]http.HandlerFunc{
+		http.MethodGet: s.handleListUsers,
+	}))
+	mux.HandleFunc("/api/v1/me", s.restMethods(map[string]http.HandlerFunc{
+		http.MethodGet: s.handleMe,
+	}))
+	mux.HandleFunc("/api/v1/openapi.json", s.restMethods(map[string]http.HandlerFunc{
+		http.MethodGet: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(openAPIDocument)
+		},
+	}))
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, apiError{Code: "NOT_FOUND", Message: "no such endpoint"})
+	})
+	return mux
+}
+
+// restMethods dispatches on the request method and answers others with 405
+func (s *Server) restMethods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	allowed := make([]string, 0, len(handlers))
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	slices.Sort(allowed)
+	allow := strings.Join(allowed, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok && r.Method == http.MethodHead {
+			handler, ok = handlers[http.MethodGet]
+		}
+		if !ok {
+			w.Header().Set("Allow", allow)
+			writeAPIError(w, http.StatusMethodNotAllowed, apiError{
+				Code:    "METHOD_NOT_ALLOWED",
+				Message: r.Method + " is not supported, use " + allow,
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleListMessages returns the latest messages, or the ones before the
+// cursor in ?before=, up to ?limit= at a time
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, TokenScopeRead) {
+		return
+	}
+	limit := defaultPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeAPIError(w, http.StatusBadRequest, apiError{
+				Code:    "BAD_REQUEST",
+				Message: fmt.Sprintf("limit must be between 1 and %d", maxPageSize),
+			})
+			return
+		}
+		limit = n
+	}
+
+	messages, cursor, err := s.resolver.messagePage(r.Context(), limit, r.URL.Query().Get("before"))
+	if errors.Is(err, errMessageNotFound) {
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: "BAD_REQUEST", Message: "unknown cursor in before"})
+		return
+	}
+	if err != nil {
+		writeResolverError(w, r, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, MessagePage{Messages: s.moderationForAdmins(r.Context(), messages), HasMore: cursor != "", NextCursor: cursor})
+}
+
+// handlePostMessage posts {"text": "..."} as the logged in user
+func (s *Server) handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok || !requireScope(w, r, TokenScopePost) {
+		return
+	}
+
+	// Requiring JSON also means browsers preflight cross-site posts
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, apiError{
+			Code:    "UNSUPPORTED_MEDIA_TYPE",
+			Message: "send the message as application/json",
+		})
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, restMaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: "BAD_REQUEST", Message: "invalid JSON body: " + err.Error()})
+		return
+	}
+	if strings.TrimSpace(body.Text) == "" {
+		writeAPIError(w, http.StatusBadRequest, apiError{Code: "BAD_REQUEST", Message: "text is required"})
+		return
+	}
+
+	if err := s.rateLimit.Allow(r.Context(), ast.Mutation, "postMessage"); err != nil {
+		writeResolverError(w, r, err)
+		return
+	}
+
+	mutation := &mutationResolver{s.resolver}
+	msg, err := mutation.PostMessage(r.Context(), user, body.Text, nil)
+	if err != nil {
+		writeResolverError(w, r, err)
+		return
+	}
+	writeAPIData(w, http.StatusCreated, s.moderationForAdmins(r.Context(), []*Message{msg})[0])
+}
+
+// moderationForAdmins leaves out the moderation of messages unless the
+// caller is an admin, like @hasRole does for GraphQL
+func (s *Server) moderationForAdmins(ctx context.Context, messages []*Message) []*Message {
+	if s.resolver.hasRole(ctx, RoleAdmin) == nil {
+		return messages
+	}
+	redacted := make([]*Message, len(messages))
+	for i, msg := range messages {
+		redacted[i] = withoutModeration(msg)
+	}
+	return redacted
+}
+
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, TokenScopeRead) {
+		return
+	}
+	users, err := (&queryResolver{s.resolver}).Users(r.Context())
+	if err != nil {
+		writeResolverError(w, r, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, map[string][]string{"users": users})
+}
+
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := requireUser(w, r)
+	if !ok || !requireScope(w, r, TokenScopeRead) {
+		return
+	}
+	role, err := s.resolver.roleOf(r.Context(), user)
+	if err != nil {
+		writeResolverError(w, r, err)
+		return
+	}
+	blocked, err := s.resolver.blockedUsers(r.Context(), user)
+	if err != nil {
+		writeResolverError(w, r, err)
+		return
+	}
+	if blocked == nil {
+		blocked = []string{}
+	}
+	writeAPIData(w, http.StatusOK, Me{User: user, Role: role, IsBot: ClientFromContext(r.Context()).IsBot(), Blocked: blocked})
+}
+
+// requireUser answers 401 for anonymous callers
+func requireUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, err := currentUser(r.Context())
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, apiError{Code: "UNAUTHORIZED", Message: "not logged in"})
+		return "", false
+	}
+	return user, true
+}
+
+// requireScope answers 403 if the caller's access token lacks scope
+func requireScope(w http.ResponseWriter, r *http.Request, scope TokenScope) bool {
+	if ClientFromContext(r.Context()).HasScope(scope) {
+		return true
+	}
+	err := scopeError(scope, r.Method+" "+r.URL.Path)
+	writeAPIError(w, http.StatusForbidden, apiError{Code: "FORBIDDEN", Message: err.Message})
+	return false
+}
+
+// writeResolverError maps the codes of resolver errors to HTTP statuses.
+// Other errors are logged and reported as internal errors.
+func writeResolverError(w http.ResponseWriter, r *http.Request, err error) {
+	var gqlErr *gqlerror.Error
+	if !errors.As(err, &gqlErr) || gqlErr.Extensions["code"] == nil {
+		slog.ErrorContext(r.Context(), "REST request failed", "path", r.URL.Path, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, apiError{Code: "INTERNAL", Message: "internal server error"})
+		return
+	}
+
+	body := apiError{Message: gqlErr.Message}
+	body.Code, _ = gqlErr.Extensions["code"].(string)
+	body.Reason, _ = gqlErr.Extensions["reason"].(string)
+
+	status := http.StatusBadRequest
+	switch body.Code {
+	case "FORBIDDEN":
+		status = http.StatusForbidden
+	case "MESSAGE_REJECTED":
+		status = http.StatusUnprocessableEntity
+	case "RATE_LIMITED":
+		status = http.StatusTooManyRequests
+		if retryAfter, ok := gqlErr.Extensions["retryAfter"].(float64); ok {
+			body.RetryAfter = retryAfter
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter))))
+		}
+	}
+	writeAPIError(w, status, body)
+}
+
+func writeAPIData(w http.ResponseWriter, status int, data interface{}) {
+	writeAPIResponse(w, status, map[string]interface{}{"data": data})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, body apiError) {
+	writeAPIResponse(w, status, map[string]apiError{"error": body})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
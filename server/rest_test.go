@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TestListMessagesPagesPastHiddenMessages checks that a page whose messages
+// are all hidden still leads to the older pages
+func TestListMessagesPagesPastHiddenMessages(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	ctx := context.Background()
+
+	var ids []string
+	pipe := s.redis.Pipeline()
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("%05d", i)
+		msg, _ := json.Marshal(&Message{ID: id, User: "alice", Text: id, Hidden: i == 2 || i == 3})
+		pipe.Set(ctx, "message:"+id, msg, 0)
+		pipe.ZAdd(ctx, "messages", &redis.Z{Score: float64(i), Member: id})
+		ids = append(ids, id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	before := ""
+	for pages := 0; pages < len(ids); pages++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages?limit=2&before="+before, nil)
+		req.AddCookie(sessionFor(s, "bob"))
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+		var body struct{ Data MessagePage }
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+
+		page := []string{}
+		for _, msg := range body.Data.Messages {
+			page = append(page, msg.ID)
+		}
+		listed = append(page, listed...)
+		if body.Data.HasMore != (body.Data.NextCursor != "") {
+			t.Errorf("hasMore %v with cursor %q", body.Data.HasMore, body.Data.NextCursor)
+		}
+		if !body.Data.HasMore {
+			break
+		}
+		before = body.Data.NextCursor
+	}
+
+	want := append(slices.Clone(ids[:2]), ids[4:]...)
+	if !slices.Equal(listed, want) {
+		t.Errorf("listed %v, want %v", listed, want)
+	}
+}
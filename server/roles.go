@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// defaultRoom is the only room of the chat until rooms are added
+const defaultRoom = "general"
+
+var roleRanks = map[Role]int{
+	RoleMember: 1,
+	RoleAdmin:  2,
+	RoleOwner:  3,
+}
+
+// roleOf returns the role stored for a user. Users listed in OWNER_USERS are
+// always owners so a fresh deployment has someone who can grant roles.
+func (r *Resolver) roleOf(ctx context.Context, user string) (Role, error) {
+	if user == "" {
+		return RoleMember, nil
+	}
+	if slices.Contains(r.config.OwnerUsers, user) {
+		return RoleOwner, nil
+	}
+
+	role, err := r.redis.HGet(ctx, "roles", user).Result()
+	if err == redis.Nil {
+		return RoleMember, nil
+	}
+	if err != nil {
+		return RoleMember, err
+	}
+	if !Role(role).IsValid() {
+		return RoleMember, fmt.Errorf("invalid role %q stored for %s", role, user)
+	}
+	return Role(role), nil
+}
+
+// hasRole implements the @hasRole directive and the admin checks of other
+// handlers. Access tokens also need the ADMIN scope for admin roles.
+func (r *Resolver) hasRole(ctx context.Context, required Role) error {
+	user, err := currentUser(ctx)
+	if err != nil {
+		return err
+	}
+	role, err := r.roleOf(ctx, user)
+	if err != nil {
+		return err
+	}
+	if roleRanks[role] < roleRanks[required] {
+		return forbiddenError(fmt.Sprintf("%s role required", strings.ToLower(required.String())))
+	}
+	// An access token only carries the admin's powers with the ADMIN scope,
+	// a READ token of an admin reads like a member's
+	if roleRanks[required] >= roleRanks[RoleAdmin] && !ClientFromContext(ctx).HasScope(TokenScopeAdmin) {
+		return scopeError(TokenScopeAdmin, strings.ToLower(required.String())+" access")
+	}
+	return nil
+}
+
+func forbiddenError(message string) error {
+	return &gqlerror.Error{Message: message, Extensions: map[string]interface{}{"code": "FORBIDDEN"}}
+}
+
+func (r *Resolver) setRole(ctx context.Context, user string, role Role) error {
+	if role == RoleMember {
+		return r.redis.HDel(ctx, "roles", user).Err()
+	}
+	return r.redis.HSet(ctx, "roles", user, role.String()).Err()
+}
+
+// checkCanPost returns an error if the author or the logged in user is banned or muted
+func (r *Resolver) checkCanPost(ctx context.Context, user string) error {
+	for _, name := range []string{user, ClientFromContext(ctx).User} {
+		if name == "" {
+			continue
+		}
+		if err := r.checkNotBanned(ctx, name); err != nil {
+			return err
+		}
+
+		ttl, err := r.redis.TTL(ctx, "mute:"+name).Result()
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			return forbiddenError(fmt.Sprintf("you are muted for another %s", ttl.Round(time.Second)))
+		}
+	}
+	return nil
+}
+
+// checkNotBanned returns an error if the user is banned
+func (r *Resolver) checkNotBanned(ctx context.Context, user string) error {
+	banned, err := r.redis.Exists(ctx, "ban:"+user).Result()
+	if err != nil {
+		return err
+	}
+	if banned > 0 {
+		return forbiddenError("you are banned from this chat")
+	}
+	return nil
+}
+
+// checkModerationTarget stops admins from acting on themselves or on users
+// with an equal or higher role
+func (r *Resolver) checkModerationTarget(ctx context.Context, target string) error {
+	actor := ClientFromContext(ctx).User
+	if target == actor {
+		return errors.New("you can't moderate yourself")
+	}
+
+	actorRole, err := r.roleOf(ctx, actor)
+	if err != nil {
+		return err
+	}
+	targetRole, err := r.roleOf(ctx, target)
+	if err != nil {
+		return err
+	}
+	if roleRanks[targetRole] >= roleRanks[actorRole] {
+		return forbiddenError(fmt.Sprintf("can't moderate a user with the %s role", strings.ToLower(targetRole.String())))
+	}
+	return nil
+}
+
+func (r *Resolver) banUser(ctx context.Context, user string) error {
+	if err := r.redis.Set(ctx, "ban:"+user, ClientFromContext(ctx).User, 0).Err(); err != nil {
+		return err
+	}
+	n := r.disconnectUser(user)
+	slog.InfoContext(ctx, "Banned user", "target", user, "subscriptions", n)
+	return nil
+}
+
+func (r *Resolver) unbanUser(ctx context.Context, user string) error {
+	return r.redis.Del(ctx, "ban:"+user).Err()
+}
+
+func (r *Resolver) muteUser(ctx context.Context, user string, duration time.Duration) error {
+	if duration <= 0 {
+		return r.redis.Del(ctx, "mute:"+user).Err()
+	}
+	return r.redis.Set(ctx, "mute:"+user, ClientFromContext(ctx).User, duration).Err()
+}
+
+func (r *Resolver) kickUser(ctx context.Context, user string, roomID string) error {
+	if roomID != defaultRoom {
+		return fmt.Errorf("unknown room %q", roomID)
+	}
+	n := r.disconnectUser(user)
+	slog.InfoContext(ctx, "Kicked user", "target", user, "room", roomID, "subscriptions", n)
+	return nil
+}
+
+// disconnectUser ends every active subscription of a user and returns how many were closed
+func (r *Resolver) disconnectUser(user string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	n := 0
+	for _, subs := range r.subscribers {
+		for _, sub := range subs {
+			if sub.user == user {
+				sub.cancel()
+				n++
+			}
+		}
+	}
+	return n
+}
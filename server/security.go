@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// nonceTemplate is replaced with a fresh nonce for every response in
+// CONTENT_SECURITY_POLICY, so pages rendered by the server can allow their
+// inline scripts with cspNonce
+const nonceTemplate = "{nonce}"
+
+type nonceContextKey struct{}
+
+// securityHeaders adds the browser security headers configured in cfg to
+// every response. Empty settings leave the header out.
+func securityHeaders(next http.Handler, cfg *ServerConfig) http.Handler {
+	policy := cfg.ContentSecurityPolicy
+	withNonce := strings.Contains(policy, nonceTemplate)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		if cfg.FrameOptions != "" {
+			header.Set("X-Frame-Options", cfg.FrameOptions)
+		}
+		if cfg.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+		if cfg.PermissionsPolicy != "" {
+			header.Set("Permissions-Policy", cfg.PermissionsPolicy)
+		}
+
+		// The playground loads its scripts from a CDN and is only enabled in
+		// development
+		if policy != "" && r.URL.Path != "/playground" {
+			if withNonce {
+				nonce := newNonce()
+				r = r.WithContext(context.WithValue(r.Context(), nonceContextKey{}, nonce))
+				header.Set("Content-Security-Policy", strings.ReplaceAll(policy, nonceTemplate, nonce))
+			} else {
+				header.Set("Content-Security-Policy", policy)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cspNonce returns the nonce allowed by the Content-Security-Policy of the
+// response, or "" if the policy doesn't use one
+func cspNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceContextKey{}).(string)
+	return nonce
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var nonceSource = regexp.MustCompile(`script-src 'self' 'nonce-([A-Za-z0-9_-]{22})'`)
+
+func TestSecurityHeaders(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.TLSMode = "files"
+	})
+	index := filepath.Join(s.config.StaticDir, "index.html")
+	if err := os.WriteFile(index, []byte("<!DOCTYPE html><title>chat</title>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{"index", http.MethodGet, "/"},
+		{"client route", http.MethodGet, "/chat"},
+		{"graphql", http.MethodPost, "/graphql"},
+		{"rest", http.MethodGet, "/api/v1/me"},
+		{"health", http.MethodGet, "/healthz"},
+	}
+	headers := []struct {
+		name  string
+		check func(value string) bool
+	}{
+		{"Content-Security-Policy", func(v string) bool {
+			return nonceSource.MatchString(v) && strings.Contains(v, "frame-ancestors 'none'") && strings.Contains(v, "object-src 'none'")
+		}},
+		{"Strict-Transport-Security", func(v string) bool { return v == "max-age=15552000" }},
+		{"X-Content-Type-Options", func(v string) bool { return v == "nosniff" }},
+		{"Referrer-Policy", func(v string) bool { return v == "strict-origin-when-cross-origin" }},
+		{"X-Frame-Options", func(v string) bool { return v == "DENY" }},
+		{"Permissions-Policy", func(v string) bool { return strings.Contains(v, "camera=()") }},
+	}
+
+	for _, route := range routes {
+		t.Run(route.name, func(t *testing.T) {
+			nonces := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(route.method, route.path, strings.NewReader(`{"query":"{ hello }"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.TLS = &tls.ConnectionState{}
+				rec := httptest.NewRecorder()
+				s.handler.ServeHTTP(rec, req)
+
+				for _, header := range headers {
+					if value := rec.Header().Get(header.name); !header.check(value) {
+						t.Errorf("%s: %q", header.name, value)
+					}
+				}
+				if m := nonceSource.FindStringSubmatch(rec.Header().Get("Content-Security-Policy")); m != nil {
+					nonces[m[1]] = true
+				}
+			}
+			if len(nonces) != 2 {
+				t.Errorf("nonce was reused across responses")
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersPlainHTTP(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.TLSMode = "files"
+	})
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	// HSTS is only honoured over HTTPS and must not be sent in the clear
+	if value := rec.Header().Get("Strict-Transport-Security"); value != "" {
+		t.Errorf("Strict-Transport-Security over HTTP: %q", value)
+	}
+
+	s, _ = newTestServer(t, nil)
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	if value := rec.Header().Get("Strict-Transport-Security"); value != "" {
+		t.Errorf("Strict-Transport-Security with TLS_MODE=off: %q", value)
+	}
+}
+
+// TestCSPNonceMatchesHandler checks that pages rendered by the server get
+// the nonce of their own response
+func TestCSPNonceMatchesHandler(t *testing.T) {
+	cfg := DefaultConfig()
+	handler := securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(cspNonce(r.Context())))
+	}), &cfg)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/github/callback", nil))
+	m := nonceSource.FindStringSubmatch(rec.Header().Get("Content-Security-Policy"))
+	if m == nil || m[1] != rec.Body.String() {
+		t.Errorf("CSP %q, handler nonce %q", rec.Header().Get("Content-Security-Policy"), rec.Body.String())
+	}
+
+	cfg.ContentSecurityPolicy = "default-src 'self'"
+	rec = httptest.NewRecorder()
+	handler = securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(cspNonce(r.Context())))
+	}), &cfg)
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Body.Len() != 0 {
+		t.Errorf("nonce %q without {nonce} in the policy", rec.Body.String())
+	}
+}
@@ -1,261 +1,390 @@
 package server
 
 import (
-	"fmt"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"context"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
 	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
 	"github.com/go-redis/redis/v8"
-	githubapi "github.com/google/go-github/v32/github"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
-	"golang.org/x/oauth2"
-	githubauth "golang.org/x/oauth2/github"
 )
 
 type WebsocketInitFunc func(ctx context.Context, initPayload transport.InitPayload) (context.Context, error)
 
 type Server struct {
+	config   *ServerConfig
 	redis    *redis.Client
-	mux      *http.ServeMux
-	handler  http.Handler
-	upgrader websocket.Upgrader
+	sessions *Sessions
+	blobs    BlobStore
+	audit    *AuditLog
+	health   *Health
+	resolver *Resolver
+	webhooks *Webhooks
+	// rateLimit is shared by GraphQL and the REST API
+	rateLimit *RateLimit
+	mux       *http.ServeMux
+	handler   http.Handler
+	origins   *OriginPolicy
+	static    http.Handler
+	upgrader  websocket.Upgrader
+
+	mutex      sync.Mutex
+	httpServer *http.Server
+	// redirectServer is the plaintext listener when TLS is on
+	redirectServer *http.Server
+	// metricsServer serves /metrics on METRICS_ADDR
+	metricsServer *http.Server
+	// baseCtx is the parent of every request context. Cancelling it closes
+	// the websocket connections, which outlive http.Server.Shutdown.
+	baseCtx    context.Context
+	closeConns context.CancelFunc
 }
 
-func NewServer(redisURL string) (*Server, error) {
-	opt, err := redis.ParseURL(redisURL)
+// NewServer creates a server for cfg. The frontend is served from assets,
+// unless it's nil or STATIC_DIR is set, in which case it's read from disk.
+func NewServer(cfg *ServerConfig, assets fs.FS) (*Server, error) {
+	opt, err := redis.ParseURL(cfg.RedisURL)
 	if err != nil {
 		return nil, err
 	}
 
+	slog.Info("Connecting to Redis", "url", redactURL(cfg.RedisURL))
 	client := redis.NewClient(opt)
+	client.AddHook(redisMetricsHook{})
+	client.AddHook(redisTracingHook{})
+
+	blobs, err := NewBlobStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := NewAuditLog(client, cfg.AuditLogFile)
+	if err != nil {
+		return nil, err
+	}
+
+	origins, err := NewOriginPolicy(cfg.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := NewSessions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if assets == nil || cfg.StaticDir != "" {
+		dir := cfg.StaticDir
+		if dir == "" {
+			dir = defaultStaticDir
+		}
+		slog.Info("Serving frontend from disk", "dir", dir)
+		assets = os.DirFS(dir)
+	}
+
+	health := NewHealth(cfg.HealthCheckTimeout)
+	health.Register("redis", func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	})
+
+	baseCtx, closeConns := context.WithCancel(transport.AppendCloseReason(context.Background(), "server is shutting down"))
 
 	server := &Server{
-		redis: client,
-		mux:   http.NewServeMux(),
+		config:   cfg,
+		redis:    client,
+		sessions: sessions,
+		blobs:    blobs,
+		audit:    audit,
+		health:   health,
+		origins:  origins,
+		static:   newStaticFiles(assets),
+		mux:      http.NewServeMux(),
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+			CheckOrigin:     origins.CheckOrigin,
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
 		},
+		baseCtx:    baseCtx,
+		closeConns: closeConns,
 	}
 
-	server.setupRoutes()
+	if err := server.setupRoutes(); err != nil {
+		return nil, err
+	}
 	return server, nil
 }
 
-func (s *Server) setupRoutes() {
-	// Setup GitHub OAuth routes
-	s.mux.HandleFunc("/auth/github", func(w http.ResponseWriter, r *http.Request) {
-		// Get the environment-specific callback URL
-		var callbackURL string
-		var baseURL string
-
-		// Get the origin from the request header
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			baseURL = origin
-		} else {
-			// Fallback to host-based URL construction
-			if r.TLS != nil || os.Getenv("NODE_ENV") == "production" {
-				baseURL = "https://" + r.Host
-			} else {
-				baseURL = "http://" + r.Host
-			}
-		}
+func (s *Server) setupRoutes() error {
+	// Health checks for fly.io and other orchestrators
+	s.mux.HandleFunc("/healthz", s.health.Liveness)
+	s.mux.HandleFunc("/readyz", s.health.Readiness)
 
-		// For development, always use the backend URL
-		if os.Getenv("NODE_ENV") != "production" {
-			baseURL = "http://localhost:8080"
-		}
+	// Setup OAuth routes, /auth/github and /auth/github/callback for GitHub
+	for _, provider := range s.config.OAuthProviders() {
+		s.mux.HandleFunc("/auth/"+provider.Name(), s.handleOAuthLogin(provider))
+		s.mux.HandleFunc("/auth/"+provider.Name()+"/callback", s.handleOAuthCallback(provider))
+	}
 
-		callbackURL = baseURL + "/auth/github/callback"
-		fmt.Printf("Using callback URL: %s\n", callbackURL)
-
-		// Create the OAuth config
-		oauthConfig := &oauth2.Config{
-			ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
-			ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
-			RedirectURL:  callbackURL,
-			Scopes: []string{
-				"user:email",
-				"read:user",
-			},
-			Endpoint: githubauth.Endpoint,
-		}
+	s.mux.HandleFunc("/auth/logout", s.handleLogout)
 
-		// Generate the authorization URL
-		url := oauthConfig.AuthCodeURL("state")
-		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
-	})
+	// Attachment downloads require a logged in user
+	s.mux.HandleFunc("/attachments/", s.handleAttachment)
 
-	s.mux.HandleFunc("/auth/github/callback", func(w http.ResponseWriter, r *http.Request) {
-		code := r.URL.Query().Get("code")
-		if code == "" {
-			http.Error(w, "Code not found", http.StatusBadRequest)
-			return
-		}
+	s.webhooks = NewWebhooks(s.redis, s.config.WebhookAllowPrivate)
 
-		var callbackURL string
-		var baseURL string
+	moderationConfig, err := s.config.ModerationConfig()
+	if err != nil {
+		return err
+	}
 
-		// Determine the base URL from the request
-		if r.TLS != nil || os.Getenv("NODE_ENV") == "production" {
-			baseURL = "https://" + r.Host
-		} else {
-			baseURL = "http://localhost:8080"
+	resolver := &Resolver{
+		config:    s.config,
+		redis:     s.redis,
+		blobs:     s.blobs,
+		unfurler:  NewUnfurler(s.redis),
+		moderator: NewModerator(s.redis, moderationConfig),
+		audit:     s.audit,
+		webhooks:  s.webhooks,
+	}
+	s.resolver = resolver
+
+	// Messages are broadcast to this instance's subscribers in memory, so
+	// there's no Redis subscriber loop to check. Once Shutdown starts
+	// completing subscriptions the instance is no longer ready, so load
+	// balancers stop sending it new clients.
+	s.health.Register("subscriptions", func(ctx context.Context) error {
+		if resolver.isClosing() {
+			return errors.New("server is shutting down")
 		}
+		return nil
+	})
 
-		callbackURL = baseURL + "/auth/github/callback"
-
-		oauthConfig := &oauth2.Config{
-			ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
-			ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
-			RedirectURL:  callbackURL,
-			Scopes: []string{
-				"user:email",
-				"read:user",
-			},
-			Endpoint: githubauth.Endpoint,
-		}
+	// Admin-only export of the audit log as JSON Lines
+	s.mux.HandleFunc("/admin/audit.jsonl", s.handleAuditExport)
+	srv := handler.New(NewExecutableSchema(Config{
+		Resolvers: resolver,
+		Directives: DirectiveRoot{
+			HasRole: hasRoleDirective(resolver),
+		},
+		Complexity: newComplexityRoot(),
+	}))
 
-		token, err := oauthConfig.Exchange(r.Context(), code)
-		if err != nil {
-			http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
-			return
-		}
+	srv.AddTransport(s.websocketTransport())
 
-		// Get user info from GitHub
-		client := githubapi.NewClient(oauthConfig.Client(r.Context(), token))
-		user, _, err := client.Users.Get(r.Context(), "")
-		if err != nil {
-			http.Error(w, "Failed to get user info", http.StatusInternalServerError)
-			return
-		}
+	srv.Use(NewMetrics())
+	srv.Use(Tracing{})
 
-		// Set the user cookie with the GitHub username
-		cookie := &http.Cookie{
-			Name:     "user_id",
-			Value:    *user.Login,
-			Path:     "/",
-			HttpOnly: false,
-			Secure:   r.TLS != nil || os.Getenv("NODE_ENV") == "production",
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   86400,
-			Domain:   r.Host,
+	// In allow-list mode only operations from the frontend's manifest are
+	// executed, otherwise clients may register queries on the fly with APQ
+	if s.config.PersistedQueriesOnly {
+		queries, err := LoadPersistedQueries(s.config.PersistedQueriesManifest)
+		if err != nil {
+			return err
 		}
-		http.SetCookie(w, cookie)
-
-		// Log cookie setting
-		fmt.Printf("Setting cookie: %+v\n", cookie)
-
-		// Determine redirect URL
-		redirectURL := "/"
-		if os.Getenv("NODE_ENV") == "production" {
-			redirectURL = "https://" + r.Host
-		} else {
-			redirectURL = "http://localhost:3000"
+		srv.Use(NewAllowList(queries))
+	} else {
+		var cache graphql.Cache = lru.New(1000)
+		if s.config.APQCache == "redis" {
+			cache = NewRedisQueryCache(s.redis)
 		}
+		srv.Use(extension.AutomaticPersistedQuery{Cache: cache})
+	}
 
-		// Add a small delay to ensure cookie is set
-		time.Sleep(100 * time.Millisecond)
-
-		// Redirect with JavaScript to ensure cookie is properly set
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprintf(w, `
-			<html>
-			<body>
-				<script>
-					document.cookie = "user_id=%s;path=/;max-age=86400;%s";
-					window.location.href = "%s";
-				</script>
-			</body>
-			</html>
-		`, *user.Login,
-			func() string {
-				if r.TLS != nil || os.Getenv("NODE_ENV") == "production" {
-					return "secure;samesite=lax"
-				}
-				return "samesite=lax"
-			}(),
-			redirectURL)
-	})
-
-	resolver := &Resolver{redis: s.redis}
-	srv := handler.New(NewExecutableSchema(Config{Resolvers: resolver}))
+	srv.Use(NewQueryLimits(s.config.QueryLimitConfig()))
+	srv.Use(TokenScopes{})
 
-	srv.AddTransport(transport.Websocket{
-		Upgrader:              s.upgrader,
-		KeepAlivePingInterval: 10 * time.Second,
-	})
+	rateLimitConfig, err := s.config.RateLimitConfig()
+	if err != nil {
+		return err
+	}
+	var limiter RateLimiter = NewMemoryRateLimiter()
+	if s.config.RateLimitBackend == "redis" {
+		limiter = NewRedisRateLimiter(s.redis)
+	}
+	s.rateLimit = NewRateLimit(limiter, rateLimitConfig)
+	srv.Use(s.rateLimit)
 
 	srv.AddTransport(transport.Options{})
+	// SSE must come first, it handles GET and POST requests that accept
+	// text/event-stream
+	srv.AddTransport(SSE{})
 	srv.AddTransport(transport.GET{})
 	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{
+		MaxUploadSize: maxAttachmentsPerMessage*maxAttachmentSize + 1<<20,
+		MaxMemory:     32 << 20,
+	})
 
-	s.mux.Handle("/graphql", srv)
+	s.mux.Handle("/graphql", countWebsockets(recordUpgrades(srv)))
+	s.mux.Handle("/api/v1/", s.restAPI())
 
 	// Only show playground in development
-	if os.Getenv("NODE_ENV") != "production" {
+	if s.config.Playground {
 		s.mux.Handle("/playground", playground.Handler("GraphQL playground", "/graphql"))
 	}
 
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins: []string{
-			"http://localhost:3000",
-			"http://localhost:8080",
-			"https://go-realtime-chat.fly.dev",
-			"ws://localhost:3000",
-			"ws://localhost:8080",
-			"wss://go-realtime-chat.fly.dev",
-		},
+		AllowOriginFunc:  s.origins.Allowed,
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Content-Type", "Authorization", "Sec-WebSocket-Protocol", "apollographql-client-name", "apollographql-client-version"},
-		ExposedHeaders:   []string{"Set-Cookie"},
+		ExposedHeaders:   []string{"Set-Cookie", "Retry-After"},
 		AllowCredentials: true,
 		Debug:            false,
 	})
 
-	// Serve static files in production
+	// Serve the frontend in production
 	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// First, try to serve static files
-		staticPath := "./static"
-		fs := http.FileServer(http.Dir(staticPath))
-
-		// Check if the path is /graphql or starts with /auth
-		if r.URL.Path == "/graphql" || strings.HasPrefix(r.URL.Path, "/auth/") {
-			s.handler.ServeHTTP(w, r)
+		// API, login and health endpoints that aren't registered, such as
+		// /auth/gitlab without GITLAB_CLIENT_ID, must never fall back to
+		// index.html
+		if strings.HasPrefix(r.URL.Path, "/auth/") || strings.HasPrefix(r.URL.Path, "/healthz") || strings.HasPrefix(r.URL.Path, "/readyz") {
+			http.NotFound(w, r)
 			return
 		}
 
-		// Check if file exists
-		path := filepath.Join(staticPath, r.URL.Path)
-		_, err := os.Stat(path)
+		s.static.ServeHTTP(w, r)
+	})
 
-		if os.IsNotExist(err) {
-			// File doesn't exist, serve index.html for SPA routing
-			http.ServeFile(w, r, filepath.Join(staticPath, "index.html"))
-			return
+	s.handler = traceRequests(securityHeaders(corsHandler.Handler(withClientInfo(s.authenticate(s.mux), s.sessions, s.config.TrustProxy)), s.config))
+	if s.config.TLSMode != "off" && s.config.HSTSMaxAge > 0 {
+		s.handler = strictTransportSecurity(s.handler, s.config.HSTSMaxAge)
+	}
+	return nil
+}
+
+// Serve listens on LISTEN_ADDR, and on HTTP_REDIRECT_ADDR if TLS is on,
+// until Shutdown is called
+func (s *Server) Serve() error {
+	tlsConfig, redirect, err := s.setupTLS()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.httpServer = &http.Server{
+		Addr:      s.config.ListenAddr,
+		Handler:   s.handler,
+		TLSConfig: tlsConfig,
+		BaseContext: func(net.Listener) context.Context {
+			return s.baseCtx
+		},
+	}
+	if tlsConfig != nil && s.config.HTTPRedirectAddr != "" {
+		s.redirectServer = &http.Server{
+			Addr:              s.config.HTTPRedirectAddr,
+			Handler:           redirect,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+	if s.config.MetricsAddr != "" {
+		metrics := http.NewServeMux()
+		metrics.Handle("/metrics", promhttp.Handler())
+		s.metricsServer = &http.Server{
+			Addr:              s.config.MetricsAddr,
+			Handler:           metrics,
+			ReadHeaderTimeout: 10 * time.Second,
 		}
+	}
+	httpServer, redirectServer, metricsServer := s.httpServer, s.redirectServer, s.metricsServer
+	s.mutex.Unlock()
 
-		// File exists, serve it
-		fs.ServeHTTP(w, r)
-	})
+	if redirectServer != nil {
+		listener, err := net.Listen("tcp", redirectServer.Addr)
+		if err != nil {
+			return err
+		}
+		go serveRedirects(redirectServer, listener)
+	}
+	if metricsServer != nil {
+		listener, err := net.Listen("tcp", metricsServer.Addr)
+		if err != nil {
+			return err
+		}
+		slog.Info("Serving metrics", "addr", metricsServer.Addr)
+		go serveMetrics(metricsServer, listener)
+	}
 
-	s.handler = corsHandler.Handler(s.mux)
+	if tlsConfig != nil {
+		slog.Info("Serving HTTPS", "addr", s.config.ListenAddr, "tls_mode", s.config.TLSMode)
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-func (s *Server) Serve(port int) error {
-	addr := fmt.Sprintf(":%d", port)
-	return http.ListenAndServe(addr, s.handler)
+// Shutdown stops accepting connections, completes every subscription, waits
+// for in-flight requests until ctx is done and then closes the remaining
+// websocket connections and the Redis client
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	httpServer, redirectServer, metricsServer := s.httpServer, s.redirectServer, s.metricsServer
+	s.mutex.Unlock()
+
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	var err error
+	if httpServer != nil {
+		// Shutdown closes the listeners first and then waits for requests
+		// that aren't websockets, so start it before completing subscriptions
+		done := make(chan error, 1)
+		go func() {
+			done <- httpServer.Shutdown(ctx)
+		}()
+
+		n := s.resolver.closeSubscriptions()
+		slog.Info("Completed subscriptions", "count", n)
+
+		err = <-done
+		if err != nil {
+			slog.Error("Failed to drain requests", "error", err)
+		}
+	} else {
+		s.resolver.closeSubscriptions()
+	}
+
+	// The websocket transport sends complete for each closed subscription
+	// from its own goroutines, give it a moment before closing the sockets
+	select {
+	case <-time.After(websocketDrainPeriod):
+	case <-ctx.Done():
+	}
+	s.closeConns()
+
+	// Deliveries still waiting for a retry go to the dead letter list, which
+	// needs Redis
+	if cerr := s.webhooks.Close(ctx); cerr != nil {
+		slog.Error("Failed to finish webhook deliveries", "error", cerr)
+	}
+	if cerr := s.audit.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := s.redis.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
 }
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer returns a server backed by miniredis. configure may change
+// the settings before the server is created.
+func newTestServer(t *testing.T, configure func(*ServerConfig)) (*Server, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+
+	cfg := DefaultConfig()
+	cfg.RedisURL = "redis://" + mr.Addr()
+	cfg.SessionSecret = strings.Repeat("s", minSessionSecretLength)
+	cfg.BlobDir = t.TempDir()
+	cfg.StaticDir = t.TempDir()
+	cfg.AllowedOrigins = []string{cfg.BaseURL, cfg.FrontendURL}
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	s, err := NewServer(&cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s, mr
+}
+
+// sessionFor returns a valid session cookie for user
+func sessionFor(s *Server, user string) *http.Cookie {
+	return &http.Cookie{Name: sessionCookie, Value: s.sessions.sign(user, time.Now().Add(time.Hour))}
+}
+
+type graphqlResult struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// errorCode returns the code of the first error, or "" if there is none
+func (r *graphqlResult) errorCode() string {
+	if len(r.Errors) == 0 {
+		return ""
+	}
+	code, _ := r.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+// doGraphQL posts query to the server's handler with the given cookies
+func doGraphQL(t *testing.T, s *Server, query string, variables map[string]interface{}, cookies ...*http.Cookie) *graphqlResult {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	var result graphqlResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	return &result
+}
+
+const postMessageMutation = `mutation($user: String!, $text: String!) { postMessage(user: $user, text: $text) { id user } }`
+
+func TestPostMessageAsCaller(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	tests := []struct {
+		name    string
+		user    string
+		cookies []*http.Cookie
+		code    string
+	}{
+		{"anonymous", "alice", nil, "FORBIDDEN"},
+		{"forged cookie", "alice", []*http.Cookie{{Name: displayCookie, Value: "alice"}}, "FORBIDDEN"},
+		{"other user", "bob", []*http.Cookie{sessionFor(s, "alice")}, "FORBIDDEN"},
+		{"bot name", "deploys[bot]", []*http.Cookie{sessionFor(s, "alice")}, "FORBIDDEN"},
+		{"own name", "alice", []*http.Cookie{sessionFor(s, "alice")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := doGraphQL(t, s, postMessageMutation, map[string]interface{}{"user": tt.user, "text": "hello " + tt.name}, tt.cookies...)
+			if code := result.errorCode(); code != tt.code {
+				t.Errorf("error code %q, want %q: %+v", code, tt.code, result.Errors)
+			}
+		})
+	}
+}
+
+// postTestMessage posts text as user and returns the message's ID
+func postTestMessage(t *testing.T, s *Server, user string, text string) string {
+	t.Helper()
+	result := doGraphQL(t, s, postMessageMutation, map[string]interface{}{"user": user, "text": text}, sessionFor(s, user))
+	if len(result.Errors) > 0 {
+		t.Fatalf("postMessage: %+v", result.Errors)
+	}
+	var data struct {
+		PostMessage struct{ ID string } `json:"postMessage"`
+	}
+	if err := json.Unmarshal(result.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data.PostMessage.ID
+}
+
+func TestShutdown(t *testing.T) {
+	addr := freeAddr(t)
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.ListenAddr = addr
+		cfg.MetricsAddr = ""
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if resp, err := http.Get("http://" + addr + "/healthz"); err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start")
+		}
+	}
+
+	// A subscription that has received a message
+	header := http.Header{}
+	header.Set("Cookie", sessionFor(s, "alice").String())
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+	conn, _, err := dialer.Dial("ws://"+addr+"/graphql", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteJSON(wsMessage{Type: "connection_init"})
+	if msg, err := readWebsocket(t, conn); err != nil || msg.Type != "connection_ack" {
+		t.Fatalf("got %+v, %v, want connection_ack", msg, err)
+	}
+	conn.WriteJSON(wsMessage{ID: "1", Type: "subscribe", Payload: map[string]interface{}{
+		"query": `subscription { messagePosted(user: "alice") { text } }`,
+	}})
+	keepPosting(t, s)
+	if msg, err := readWebsocket(t, conn); err != nil || msg.Type != "next" {
+		t.Fatalf("got %+v, %v, want next", msg, err)
+	}
+
+	// A POST whose body is still being sent when Shutdown starts
+	query, _ := json.Marshal(map[string]interface{}{
+		"query":     postMessageMutation,
+		"variables": map[string]interface{}{"user": "alice", "text": "sent during shutdown"},
+	})
+	post, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer post.Close()
+	fmt.Fprintf(post, "POST /graphql HTTP/1.1\r\nHost: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\nCookie: %s\r\n\r\n%s",
+		addr, len(query), sessionFor(s, "alice"), query[:10])
+	// Give the server a moment to pick it up, idle connections are closed
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	for {
+		msg, err := readWebsocket(t, conn)
+		if err != nil {
+			t.Fatalf("connection ended without complete: %v", err)
+		}
+		if msg.Type == "complete" && msg.ID == "1" {
+			break
+		}
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned with a request in flight: %v", err)
+	default:
+	}
+
+	// The request still reaches Redis
+	post.Write(query[10:])
+	post.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(post), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result graphqlResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(result.Errors) > 0 {
+		t.Errorf("in-flight request: %d %v", resp.StatusCode, result.Errors)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+	if err := s.redis.Ping(context.Background()).Err(); err != redis.ErrClosed {
+		t.Errorf("Redis after Shutdown: %v, want it closed", err)
+	}
+}
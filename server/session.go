@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionCookie holds the signed login. It's HttpOnly, so scripts can't
+	// read or forge it.
+	sessionCookie = "session"
+
+	// displayCookie tells the frontend who is logged in. The server never
+	// reads it.
+	displayCookie = "user_id"
+
+	// minSessionSecretLength is the shortest SESSION_SECRET accepted
+	minSessionSecretLength = 32
+)
+
+var errInvalidSession = errors.New("invalid session")
+
+// Sessions signs and verifies the session cookie set by the GitHub login.
+// The cookie carries the login and its expiry, signed with HMAC-SHA256 under
+// SESSION_SECRET, so it can be checked without a lookup.
+type Sessions struct {
+	secret []byte
+	domain string
+	secure bool
+	maxAge time.Duration
+}
+
+// NewSessions returns the sessions of cfg. Without SESSION_SECRET, which is
+// only allowed in development, a random secret is used. That logs everyone
+// out on restart and doesn't work with more than one instance.
+func NewSessions(cfg *ServerConfig) (*Sessions, error) {
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		slog.Warn("SESSION_SECRET is not set, sessions won't survive a restart")
+		secret = make([]byte, minSessionSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Sessions{
+		secret: secret,
+		domain: cfg.CookieDomain,
+		secure: cfg.CookieSecure,
+		maxAge: cfg.CookieMaxAge,
+	}, nil
+}
+
+// sign returns the cookie value for user, valid until expires
+func (s *Sessions) sign(user string, expires time.Time) string {
+	payload := user + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + s.signature(payload)
+}
+
+func (s *Sessions) signature(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the user of a cookie value with a valid signature that
+// hasn't expired. GitHub logins can't contain dots.
+func (s *Sessions) verify(value string, now time.Time) (string, error) {
+	payload, signature, ok := cutLast(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.signature(payload))) {
+		return "", errInvalidSession
+	}
+	user, expires, ok := cutLast(payload, ".")
+	if !ok || user == "" {
+		return "", errInvalidSession
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !now.Before(time.Unix(unix, 0)) {
+		return "", errInvalidSession
+	}
+	return user, nil
+}
+
+// User returns the logged in user of r, or "" if the session cookie is
+// missing, tampered with or expired
+func (s *Sessions) User(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	user, err := s.verify(cookie.Value, time.Now())
+	if err != nil {
+		slog.DebugContext(r.Context(), "Ignored invalid session cookie")
+		return ""
+	}
+	return user
+}
+
+// Login sets the session cookie for user and the cookie the frontend reads
+// the user from
+func (s *Sessions) Login(w http.ResponseWriter, user string) {
+	session := s.cookie(sessionCookie, s.sign(user, time.Now().Add(s.maxAge)))
+	session.HttpOnly = true
+	http.SetCookie(w, session)
+	http.SetCookie(w, s.cookie(displayCookie, user))
+}
+
+// Logout expires both cookies. They must have the attributes they were set
+// with, or the browser keeps them.
+func (s *Sessions) Logout(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, displayCookie} {
+		cookie := s.cookie(name, "")
+		cookie.MaxAge = -1
+		cookie.HttpOnly = name == sessionCookie
+		http.SetCookie(w, cookie)
+	}
+}
+
+func (s *Sessions) cookie(name string, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   s.domain,
+		MaxAge:   int(s.maxAge.Seconds()),
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
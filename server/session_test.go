@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSessions(t *testing.T) *Sessions {
+	t.Helper()
+	sessions, err := NewSessions(&ServerConfig{
+		SessionSecret: strings.Repeat("s", minSessionSecretLength),
+		CookieMaxAge:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func TestSessionVerify(t *testing.T) {
+	sessions := testSessions(t)
+	now := time.Now()
+	valid := sessions.sign("octocat", now.Add(time.Hour))
+	_, signature, _ := cutLast(valid, ".")
+	other, _ := NewSessions(&ServerConfig{SessionSecret: strings.Repeat("o", minSessionSecretLength)})
+
+	tests := []struct {
+		name  string
+		value string
+		user  string
+	}{
+		{"valid", valid, "octocat"},
+		{"unsigned login", "octocat", ""},
+		{"other user", strings.Replace(valid, "octocat", "owner", 1), ""},
+		{"extended expiry", "octocat.9999999999." + signature, ""},
+		{"other secret", other.sign("octocat", now.Add(time.Hour)), ""},
+		{"expired", sessions.sign("octocat", now.Add(-time.Second)), ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := sessions.verify(tt.value, now)
+			if user != tt.user || (err == nil) != (tt.user != "") {
+				t.Errorf("verify(%q) = %q, %v, want %q", tt.value, user, err, tt.user)
+			}
+		})
+	}
+}
+
+func TestSessionCookies(t *testing.T) {
+	sessions := testSessions(t)
+	sessions.domain = "chat.example.com"
+
+	rec := httptest.NewRecorder()
+	sessions.Login(rec, "octocat")
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("got %d cookies, want 2", len(cookies))
+	}
+	for _, cookie := range cookies {
+		if cookie.Domain != "chat.example.com" || cookie.Path != "/" {
+			t.Errorf("%s: domain %q, path %q", cookie.Name, cookie.Domain, cookie.Path)
+		}
+		if cookie.HttpOnly != (cookie.Name == sessionCookie) {
+			t.Errorf("%s: HttpOnly = %v", cookie.Name, cookie.HttpOnly)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	if user := sessions.User(req); user != "octocat" {
+		t.Errorf("User() = %q, want octocat", user)
+	}
+
+	// The display cookie alone doesn't log anyone in
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: displayCookie, Value: "octocat"})
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: "octocat"})
+	if user := sessions.User(req); user != "" {
+		t.Errorf("User() = %q for a forged session", user)
+	}
+
+	rec = httptest.NewRecorder()
+	sessions.Logout(rec)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge >= 0 || cookie.Domain != "chat.example.com" {
+			t.Errorf("%s: MaxAge %d, domain %q", cookie.Name, cookie.MaxAge, cookie.Domain)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.CookieDomain = "chat.example.com"
+		cfg.CookieSecure = true
+		cfg.AllowedOrigins = []string{"https://chat.example.com"}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		origin string
+		status int
+	}{
+		{"get", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"foreign origin", http.MethodPost, "https://evil.example.net", http.StatusForbidden},
+		{"allowed origin", http.MethodPost, "https://chat.example.com", http.StatusNoContent},
+		{"same origin", http.MethodPost, "http://example.com", http.StatusNoContent},
+		{"no origin", http.MethodPost, "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/auth/logout", nil)
+			req.AddCookie(sessionFor(s, "alice"))
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			s.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+
+			cookies := rec.Result().Cookies()
+			if tt.status != http.StatusNoContent {
+				if len(cookies) != 0 {
+					t.Errorf("cookies changed: %v", cookies)
+				}
+				return
+			}
+			if len(cookies) != 2 {
+				t.Fatalf("got %d cookies, want 2", len(cookies))
+			}
+			// Browsers only replace cookies with the same domain and path
+			for _, cookie := range cookies {
+				if cookie.MaxAge >= 0 || cookie.Domain != "chat.example.com" || cookie.Path != "/" || !cookie.Secure {
+					t.Errorf("%s not cleared: %+v", cookie.Name, cookie)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// sseHeartbeatInterval keeps proxies from closing idle streams
+var sseHeartbeatInterval = 15 * time.Second
+
+const (
+	// sseRetry is how long EventSource waits before reconnecting, in ms
+	sseRetry = 3000
+
+	// sseMaxBodySize limits POST bodies, uploads go through the multipart
+	// transport instead
+	sseMaxBodySize = 1 << 20
+)
+
+type lastEventIDContextKey struct{}
+
+// SSE serves operations, mainly subscriptions, as text/event-stream for
+// clients behind proxies that don't pass websockets. It accepts a POST with
+// a JSON body like the POST transport, or a GET with the parameters in the
+// query string for EventSource. Every result is a "next" event, followed by
+// a "complete" event once the operation is done.
+//
+// Results of root fields that select an id, such as messagePosted { id },
+// carry it as the event ID. Clients resume after a dropped connection by
+// sending it back in Last-Event-ID, which EventSource does on its own.
+type SSE struct{}
+
+var _ graphql.Transport = SSE{}
+
+func (SSE) Supports(r *http.Request) bool {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return true
+	case http.MethodPost:
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		return err == nil && mediaType == "application/json"
+	}
+	return false
+}
+
+func (SSE) Do(w http.ResponseWriter, r *http.Request, exec graphql.GraphExecutor) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	start := graphql.Now()
+	params, err := sseParams(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, exec.DispatchError(r.Context(), gqlerror.List{gqlerror.Errorf("%s", err)}))
+		return
+	}
+	params.Headers = r.Header
+	params.ReadTime = graphql.TraceTiming{Start: start, End: graphql.Now()}
+
+	ctx := r.Context()
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		ctx = context.WithValue(ctx, lastEventIDContextKey{}, id)
+	}
+
+	rc, opErr := exec.CreateOperationContext(ctx, params)
+	ctx = graphql.WithOperationContext(ctx, rc)
+	// Like the GET transport, never run mutations from a URL
+	if opErr == nil && r.Method == http.MethodGet && rc.Operation.Operation == ast.Mutation {
+		opErr = gqlerror.List{gqlerror.Errorf("mutations are not allowed over GET")}
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	flusher.Flush()
+
+	if opErr != nil {
+		writeSSEResponse(w, exec.DispatchError(ctx, opErr))
+		fmt.Fprint(w, "event: complete\ndata:\n\n")
+		flusher.Flush()
+		return
+	}
+
+	// Responses block until the next result, so they're read in their own
+	// goroutine while this one writes them and the heartbeats
+	responses, ctx := exec.DispatchOperation(ctx, rc)
+	results := make(chan *graphql.Response)
+	go func() {
+		defer close(results)
+		for {
+			response := responses(ctx)
+			if response == nil {
+				return
+			}
+			// Subscription results share a buffer that the next call
+			// overwrites
+			response.Data = slices.Clone(response.Data)
+			select {
+			case results <- response:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case response, ok := <-results:
+			if !ok {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				flusher.Flush()
+				return
+			}
+			writeSSEResponse(w, response)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// sseParams reads the operation from the query string of a GET or the JSON
+// body of a POST
+func sseParams(r *http.Request) (*graphql.RawParams, error) {
+	params := &graphql.RawParams{}
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(io.LimitReader(r.Body, sseMaxBodySize))
+		decoder.UseNumber()
+		if err := decoder.Decode(params); err != nil {
+			return nil, fmt.Errorf("json request body could not be decoded: %w", err)
+		}
+		return params, nil
+	}
+
+	query := r.URL.Query()
+	params.Query = query.Get("query")
+	params.OperationName = query.Get("operationName")
+	for name, target := range map[string]*map[string]interface{}{
+		"variables":  &params.Variables,
+		"extensions": &params.Extensions,
+	} {
+		if value := query.Get(name); value != "" {
+			decoder := json.NewDecoder(strings.NewReader(value))
+			decoder.UseNumber()
+			if err := decoder.Decode(target); err != nil {
+				return nil, fmt.Errorf("%s could not be decoded: %w", name, err)
+			}
+		}
+	}
+	return params, nil
+}
+
+// writeSSEResponse writes a "next" event with the ID of the result if it has
+// one
+func writeSSEResponse(w io.Writer, response *graphql.Response) {
+	b, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
+	}
+	if id := responseID(response); id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: next\ndata: %s\n\n", b)
+}
+
+// responseID returns the id of a result with a single root field such as
+// {"messagePosted": {"id": "..."}}
+func responseID(response *graphql.Response) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(response.Data, &fields) != nil || len(fields) != 1 {
+		return ""
+	}
+	for _, field := range fields {
+		var object struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(field, &object) == nil && !strings.ContainsAny(object.ID, "\r\n") {
+			return object.ID
+		}
+	}
+	return ""
+}
+
+func writeJSON(w io.Writer, response *graphql.Response) {
+	b, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(b)
+}
+
+// lastEventID returns the ID of the last event an SSE client received before
+// reconnecting, or "" if it isn't resuming
+func lastEventID(ctx context.Context) string {
+	id, _ := ctx.Value(lastEventIDContextKey{}).(string)
+	return id
+}
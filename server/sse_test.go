@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sseSubscription = `subscription { messagePosted(user: "alice") { id text } }`
+
+type sseEvent struct {
+	ID      string
+	Event   string
+	Data    string
+	Retry   string
+	Comment string
+}
+
+// openSSE sends query as an EventSource GET and returns a reader of the
+// stream, which is closed when the test ends
+func openSSE(t *testing.T, s *Server, query string, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	server := httptest.NewServer(s.handler)
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/graphql?query="+url.QueryEscape(query), nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.AddCookie(sessionFor(s, "alice"))
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res, bufio.NewReader(res.Body)
+}
+
+// readSSEEvent reads the fields up to the next blank line
+func readSSEEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var event sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		if comment, ok := strings.CutPrefix(line, ":"); ok {
+			event.Comment = strings.TrimSpace(comment)
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "id":
+			event.ID = value
+		case "event":
+			event.Event = value
+		case "data":
+			event.Data = value
+		case "retry":
+			event.Retry = value
+		}
+	}
+}
+
+func TestSSESubscription(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	res, stream := openSSE(t, s, sseSubscription, "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if event := readSSEEvent(t, stream); event.Retry != "3000" {
+		t.Errorf("first event %+v, want retry: 3000", event)
+	}
+
+	keepPosting(t, s)
+	event := readSSEEvent(t, stream)
+	if event.Event != "next" || event.ID == "" || !strings.Contains(event.Data, `"id":"`+event.ID+`"`) {
+		t.Errorf("got %+v, want a next event with the message ID", event)
+	}
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { sseHeartbeatInterval = interval }(sseHeartbeatInterval)
+	sseHeartbeatInterval = 50 * time.Millisecond
+
+	s, _ := newTestServer(t, nil)
+	_, stream := openSSE(t, s, sseSubscription, "")
+	readSSEEvent(t, stream)
+	if event := readSSEEvent(t, stream); event.Comment != "heartbeat" || event.Event != "" {
+		t.Errorf("got %+v, want a heartbeat comment", event)
+	}
+}
+
+func TestSSEMutationOverGet(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	_, stream := openSSE(t, s, `mutation { postMessage(user: "alice", text: "from a link") { id } }`, "")
+	readSSEEvent(t, stream)
+
+	if event := readSSEEvent(t, stream); event.Event != "next" || !strings.Contains(event.Data, "mutations are not allowed over GET") {
+		t.Errorf("got %+v, want an error", event)
+	}
+	if event := readSSEEvent(t, stream); event.Event != "complete" {
+		t.Errorf("got %+v, want complete", event)
+	}
+	if authors := messageAuthors(t, s, "alice"); len(authors) != 0 {
+		t.Errorf("mutation ran, messages by %v", authors)
+	}
+}
+
+func TestSSEResume(t *testing.T) {
+	s, mr := newTestServer(t, nil)
+	ids := []string{
+		postTestMessage(t, s, "bob", "first"),
+		postTestMessage(t, s, "bob", "second"),
+		postTestMessage(t, s, "bob", "third"),
+	}
+	// Put them in the same second, which the messages set can't order
+	for _, id := range ids {
+		if _, err := mr.ZAdd("messages", 1700000000, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, stream := openSSE(t, s, sseSubscription, ids[1])
+	readSSEEvent(t, stream)
+	if event := readSSEEvent(t, stream); event.ID != ids[2] {
+		t.Fatalf("got %+v, want the third message", event)
+	}
+
+	// Anything after that is a new message, not a repeated one
+	keepPosting(t, s)
+	if event := readSSEEvent(t, stream); event.Event != "next" || event.ID == ids[0] || event.ID == ids[1] || event.ID == ids[2] {
+		t.Errorf("got %+v, want a new message", event)
+	}
+}
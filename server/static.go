@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashedAsset matches file names with a content hash, such as
+// js/app.3f2a91c4.js, which never change and can be cached forever
+var hashedAsset = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// precompressed are the encodings the frontend build may store next to a
+// file, in order of preference
+var precompressed = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticFiles serves the frontend from an embedded or on-disk file system.
+// Paths that don't exist fall back to index.html for client-side routing.
+type staticFiles struct {
+	fsys fs.FS
+
+	mutex sync.Mutex
+	etags map[string]staticETag
+}
+
+type staticETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func newStaticFiles(fsys fs.FS) *staticFiles {
+	return &staticFiles{fsys: fsys, etags: make(map[string]staticETag)}
+}
+
+func (s *staticFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if status := checkStaticPath(r.URL.Path); status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || !s.isFile(name) {
+		name = "index.html"
+	}
+
+	if name == "index.html" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else if hashedAsset.MatchString(name) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	served := name
+	accepted := r.Header.Get("Accept-Encoding")
+	for _, p := range precompressed {
+		if acceptsEncoding(accepted, p.encoding) && s.isFile(name+p.extension) {
+			served = name + p.extension
+			w.Header().Set("Content-Encoding", p.encoding)
+			break
+		}
+	}
+
+	if err := s.serveFile(w, r, served); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Only happens without a frontend build
+			http.NotFound(w, r)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to serve static file", "file", served, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (s *staticFiles) isFile(name string) bool {
+	info, err := fs.Stat(s.fsys, name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (s *staticFiles) serveFile(w http.ResponseWriter, r *http.Request, name string) error {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+
+	etag, err := s.etag(name, info, content)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+
+	// ServeContent handles If-None-Match and ranges. Embedded files have no
+	// modification time, so the ETag is the only validator.
+	http.ServeContent(w, r, name, info.ModTime(), content)
+	return nil
+}
+
+// etag hashes the content once per file version
+func (s *staticFiles) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	s.mutex.Lock()
+	cached, ok := s.etags[name]
+	s.mutex.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+
+	s.mutex.Lock()
+	s.etags[name] = staticETag{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	s.mutex.Unlock()
+	return etag, nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+// checkStaticPath rejects paths that try to leave the frontend directory or
+// reach hidden files such as .env, instead of falling back to index.html
+func checkStaticPath(p string) int {
+	if strings.ContainsAny(p, "\\\x00") {
+		return http.StatusBadRequest
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return http.StatusBadRequest
+		}
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return http.StatusNotFound
+		}
+	}
+	return http.StatusOK
+}
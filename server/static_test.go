@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+func newTestStaticFiles() *staticFiles {
+	return newStaticFiles(fstest.MapFS{
+		"index.html":               {Data: []byte("<html>index</html>")},
+		"favicon.ico":              {Data: []byte("icon")},
+		"js/app.3f2a91c4.js":       {Data: []byte("app")},
+		"js/app.3f2a91c4.js.br":    {Data: []byte("app in brotli")},
+		"js/app.3f2a91c4.js.gz":    {Data: []byte("app in gzip")},
+		".env":                     {Data: []byte("SESSION_SECRET=secret")},
+		".well-known/security.txt": {Data: []byte("Contact: security@example.com")},
+	})
+}
+
+// getStatic requests target from files with the given headers
+func getStatic(files *staticFiles, target string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	files.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestStaticCacheControl(t *testing.T) {
+	files := newTestStaticFiles()
+	tests := []struct {
+		path         string
+		body         string
+		cacheControl string
+	}{
+		{"/", "<html>index</html>", "no-cache"},
+		// Client-side routes get the index
+		{"/rooms/general", "<html>index</html>", "no-cache"},
+		{"/js/app.3f2a91c4.js", "app", "public, max-age=31536000, immutable"},
+		{"/favicon.ico", "icon", "public, max-age=0, must-revalidate"},
+		{"/.well-known/security.txt", "Contact: security@example.com", "public, max-age=0, must-revalidate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := getStatic(files, tt.path, nil)
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.body {
+				t.Fatalf("status %d, body %q", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("Cache-Control %q, want %q", got, tt.cacheControl)
+			}
+		})
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	files := newTestStaticFiles()
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"", "", "app"},
+		{"gzip", "gzip", "app in gzip"},
+		{"gzip, deflate, br", "br", "app in brotli"},
+		{"br;q=0, gzip", "gzip", "app in gzip"},
+		{"identity", "", "app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			rec := getStatic(files, "/js/app.3f2a91c4.js", map[string]string{"Accept-Encoding": tt.acceptEncoding})
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.body {
+				t.Fatalf("status %d, body %q, want %q", rec.Code, rec.Body, tt.body)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding %q, want %q", got, tt.encoding)
+			}
+			// The type is that of the original, not of the .br or .gz file
+			if got := rec.Header().Get("Content-Type"); got != "text/javascript; charset=utf-8" {
+				t.Errorf("Content-Type %q", got)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary %q, want Accept-Encoding", got)
+			}
+		})
+	}
+}
+
+func TestStaticETag(t *testing.T) {
+	files := newTestStaticFiles()
+	rec := getStatic(files, "/favicon.ico", nil)
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	rec = getStatic(files, "/favicon.ico", map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: status %d, body %q, want 304", rec.Code, rec.Body)
+	}
+	rec = getStatic(files, "/favicon.ico", map[string]string{"If-None-Match": `"stale"`})
+	if rec.Code != http.StatusOK || rec.Body.String() != "icon" {
+		t.Errorf("stale If-None-Match: status %d, body %q, want 200", rec.Code, rec.Body)
+	}
+
+	// Each encoding has its own ETag
+	gzipped := getStatic(files, "/js/app.3f2a91c4.js", map[string]string{"Accept-Encoding": "gzip"}).Header().Get("ETag")
+	plain := getStatic(files, "/js/app.3f2a91c4.js", nil).Header().Get("ETag")
+	if gzipped == plain {
+		t.Errorf("gzip and identity share the ETag %s", plain)
+	}
+}
+
+func TestCheckStaticPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/", http.StatusOK},
+		{"/js/app.3f2a91c4.js", http.StatusOK},
+		{"/.well-known/security.txt", http.StatusOK},
+		{"/../go.mod", http.StatusBadRequest},
+		{"/js/../../etc/passwd", http.StatusBadRequest},
+		{"/..\\go.mod", http.StatusBadRequest},
+		{"/index.html\x00.js", http.StatusBadRequest},
+		{"/.env", http.StatusNotFound},
+		{"/.git/config", http.StatusNotFound},
+		{"/js/.hidden.js", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if status := checkStaticPath(tt.path); status != tt.status {
+			t.Errorf("checkStaticPath(%q) = %d, want %d", tt.path, status, tt.status)
+		}
+	}
+
+	// Rejected paths don't fall back to the index
+	files := newTestStaticFiles()
+	for target, status := range map[string]int{"/.env": http.StatusNotFound, "/js/../../go.mod": http.StatusBadRequest} {
+		if rec := getStatic(files, target, nil); rec.Code != status {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, status)
+		}
+	}
+}
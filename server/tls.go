@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// setupTLS returns the TLS config for TLS_MODE and the handler for the
+// plaintext listener, which redirects to HTTPS and answers ACME challenges.
+// The config is nil if TLS is off.
+func (s *Server) setupTLS() (*tls.Config, http.Handler, error) {
+	redirect := redirectToHTTPS(s.config.ListenAddr)
+
+	switch s.config.TLSMode {
+	case "files":
+		certs, err := newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+			GetCertificate: certs.GetCertificate,
+		}, redirect, nil
+	case "acme":
+		manager, err := s.acmeManager()
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig := manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, manager.HTTPHandler(redirect), nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// acmeManager obtains and renews certificates for ACME_DOMAINS. Certificates
+// are issued with TLS-ALPN-01 on port 443, or HTTP-01 when HTTP_REDIRECT_ADDR
+// listens on port 80. ACME_DIRECTORY_URL and ACME_CA_FILE point it to a
+// staging or test CA instead of Let's Encrypt.
+func (s *Server) acmeManager() (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: s.config.ACMEDirectoryURL}
+	if s.config.ACMECAFile != "" {
+		pem, err := os.ReadFile(s.config.ACMECAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in ACME_CA_FILE %s", s.config.ACMECAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(s.config.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(s.config.ACMEDomains...),
+		Email:      s.config.ACMEEmail,
+		Client:     client,
+	}, nil
+}
+
+// certReloader serves a certificate from files and picks up renewed files
+// without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+// reload loads the files if they changed since the last load
+func (r *certReloader) reload() error {
+	var modTime time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		slog.Info("Reloaded TLS certificate", "file", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// GetCertificate keeps serving the previous certificate if the files are
+// being replaced or invalid
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if err := r.reload(); err != nil {
+			slog.Error("Failed to reload TLS certificate", "error", err)
+		}
+	}
+	return r.cert, nil
+}
+
+// redirectToHTTPS redirects to the same URL on the TLS listener
+func redirectToHTTPS(listenAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// strictTransportSecurity tells browsers to only use HTTPS from now on. The
+// header is ignored over plain HTTP, so it's only sent on TLS connections.
+func strictTransportSecurity(next http.Handler, maxAge time.Duration) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveRedirects runs the plaintext listener until it's shut down
+func serveRedirects(server *http.Server, listener net.Listener) {
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP redirect listener failed", "error", err)
+	}
+}
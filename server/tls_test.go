@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name and its key
+func writeTestCert(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedName returns the name of the certificate the reloader serves once
+// the check interval passed
+func servedName(t *testing.T, certs *certReloader) string {
+	t.Helper()
+	certs.mutex.Lock()
+	certs.checked = time.Now().Add(-certCheckInterval)
+	certs.mutex.Unlock()
+
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first.example.com")
+
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.TLSMode = "files"
+		cfg.TLSCertFile = certFile
+		cfg.TLSKeyFile = keyFile
+	})
+	tlsConfig, _, err := s.setupTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.GetCertificate == nil {
+		t.Fatalf("TLS config %+v", tlsConfig)
+	}
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, certs); name != "first.example.com" {
+		t.Errorf("serving %s, want first.example.com", name)
+	}
+
+	// Renewed files are picked up without a restart
+	writeTestCert(t, certFile, keyFile, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if name := servedName(t, certs); name != "second.example.com" {
+		t.Errorf("serving %s after renewal, want second.example.com", name)
+	}
+
+	// Broken files keep the previous certificate
+	if err := os.WriteFile(keyFile, []byte("half written"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if name := servedName(t, certs); name != "second.example.com" {
+		t.Errorf("serving %s with a broken key, want second.example.com", name)
+	}
+
+	if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("loaded a missing certificate")
+	}
+}
+
+// TestACMEDirectory checks that ACME_DIRECTORY_URL and ACME_CA_FILE point the
+// client at another CA, such as Pebble, which serves its directory over TLS
+// with its own root
+func TestACMEDirectory(t *testing.T) {
+	ca := httptest.NewTLSServer(nil)
+	defer ca.Close()
+	ca.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dir" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.URL + "/nonce-plz",
+			"newAccount": ca.URL + "/sign-me-up",
+			"newOrder":   ca.URL + "/order-plz",
+			"revokeCert": ca.URL + "/revoke-cert",
+			"keyChange":  ca.URL + "/rollover-account-key",
+		})
+	})
+
+	caFile := filepath.Join(t.TempDir(), "pebble.minica.pem")
+	root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})
+	if err := os.WriteFile(caFile, root, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.TLSMode = "acme"
+		cfg.ACMEDomains = []string{"chat.example.com"}
+		cfg.ACMECacheDir = t.TempDir()
+		cfg.ACMEDirectoryURL = ca.URL + "/dir"
+		cfg.ACMECAFile = caFile
+	})
+	manager, err := s.acmeManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory, err := manager.Client.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if directory.OrderURL != ca.URL+"/order-plz" {
+		t.Errorf("order URL %s, want the test CA's", directory.OrderURL)
+	}
+
+	if _, _, err := s.setupTLS(); err != nil {
+		t.Error(err)
+	}
+
+	// Without the root the test CA isn't trusted
+	s.config.ACMECAFile = ""
+	manager, err = s.acmeManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Client.Discover(context.Background()); err == nil {
+		t.Error("test CA was trusted without ACME_CA_FILE")
+	}
+
+	s.config.ACMECAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := s.acmeManager(); err == nil {
+		t.Error("missing ACME_CA_FILE was ignored")
+	}
+}
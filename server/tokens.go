@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/ksuid"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	// tokenPrefix makes leaked tokens easy to recognize for secret scanners
+	tokenPrefix = "rtc_"
+
+	// botSuffix marks bot accounts. GitHub logins can't contain brackets, so
+	// bots never clash with users.
+	botSuffix = "[bot]"
+
+	maxAccessTokensPerUser = 25
+	maxTokenNameLength     = 100
+)
+
+// botName matches the name a bot is created with, before botSuffix
+var botName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,38}$`)
+
+// AccessToken lets scripts and bots use the API as a user or bot account.
+// Only the SHA-256 hash of the secret is stored. Tokens are long random
+// strings, so a slow password hash wouldn't add anything.
+type AccessToken struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	User      string       `json:"user"`
+	Scopes    []TokenScope `json:"scopes"`
+	IsBot     bool         `json:"isBot"`
+	CreatedBy string       `json:"createdBy"`
+	CreatedAt Time         `json:"createdAt"`
+	Hash      string       `json:"hash"`
+}
+
+func accessTokenKey(id string) string {
+	return "access_token:" + id
+}
+
+func accessTokenHashKey(hash string) string {
+	return "access_token_hash:" + hash
+}
+
+func accessTokensKey(user string) string {
+	return "access_tokens:" + user
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func isBotName(user string) bool {
+	return strings.HasSuffix(user, botSuffix)
+}
+
+func invalidTokenError() *gqlerror.Error {
+	return &gqlerror.Error{Message: "invalid access token", Extensions: map[string]interface{}{"code": "UNAUTHORIZED"}}
+}
+
+var errInvalidToken = errors.New("invalid access token")
+
+// authenticateToken returns the access token of an Authorization header
+// value such as "Bearer rtc_...". Unknown or revoked tokens return
+// errInvalidToken.
+func (r *Resolver) authenticateToken(ctx context.Context, authorization string) (*AccessToken, error) {
+	scheme, secret, _ := strings.Cut(strings.TrimSpace(authorization), " ")
+	secret = strings.TrimSpace(secret)
+	if !strings.EqualFold(scheme, "Bearer") || !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, errInvalidToken
+	}
+
+	id, err := r.redis.Get(ctx, accessTokenHashKey(hashToken(secret))).Result()
+	if err == redis.Nil {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	token, err := r.accessToken(ctx, id)
+	if err == redis.Nil {
+		return nil, errInvalidToken
+	}
+	return token, err
+}
+
+func (r *Resolver) accessToken(ctx context.Context, id string) (*AccessToken, error) {
+	tokenJSON, err := r.redis.Get(ctx, accessTokenKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var token AccessToken
+	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// accessTokens lists the tokens of a user or bot, oldest first
+func (r *Resolver) accessTokens(ctx context.Context, user string) ([]*AccessToken, error) {
+	ids, err := r.redis.SMembers(ctx, accessTokensKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	tokens := []*AccessToken{}
+	for _, id := range ids {
+		token, err := r.accessToken(ctx, id)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+// createAccessToken stores a new token for user and returns it with its
+// secret
+func (r *Resolver) createAccessToken(ctx context.Context, user string, name string, scopes []TokenScope) (*NewAccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxTokenNameLength {
+		return nil, fmt.Errorf("token name must be 1 to %d characters", maxTokenNameLength)
+	}
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	count, err := r.redis.SCard(ctx, accessTokensKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxAccessTokensPerUser {
+		return nil, fmt.Errorf("%s already has %d access tokens, revoke one first", user, count)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	token := &AccessToken{
+		ID:        ksuid.New().String(),
+		Name:      name,
+		User:      user,
+		Scopes:    scopes,
+		IsBot:     isBotName(user),
+		CreatedBy: ClientFromContext(ctx).User,
+		CreatedAt: Time{Time: time.Now()},
+		Hash:      hashToken(secret),
+	}
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := r.redis.TxPipeline()
+	pipe.Set(ctx, accessTokenKey(token.ID), tokenJSON, 0)
+	pipe.Set(ctx, accessTokenHashKey(token.Hash), token.ID, 0)
+	pipe.SAdd(ctx, accessTokensKey(user), token.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	r.audit.Record(ctx, "TOKEN_CREATED", token.CreatedBy, user, fmt.Sprintf("%s %q %v", token.ID, name, scopes))
+	return &NewAccessToken{Token: secret, AccessToken: token}, nil
+}
+
+// revokeAccessToken deletes a token and ends the subscriptions opened with it
+func (r *Resolver) revokeAccessToken(ctx context.Context, token *AccessToken) error {
+	pipe := r.redis.TxPipeline()
+	pipe.Del(ctx, accessTokenKey(token.ID))
+	pipe.Del(ctx, accessTokenHashKey(token.Hash))
+	pipe.SRem(ctx, accessTokensKey(token.User), token.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	n := r.disconnectToken(token.ID)
+	r.audit.Record(ctx, "TOKEN_REVOKED", ClientFromContext(ctx).User, token.User, token.ID)
+	slog.InfoContext(ctx, "Revoked access token", "token_id", token.ID, "user", token.User, "subscriptions", n)
+	return nil
+}
+
+// disconnectToken ends every active subscription opened with an access token
+// and returns how many were closed
+func (r *Resolver) disconnectToken(id string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	n := 0
+	for _, subs := range r.subscribers {
+		for _, sub := range subs {
+			if sub.token == id {
+				sub.cancel()
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (r *Resolver) bots(ctx context.Context) ([]string, error) {
+	bots, err := r.redis.HKeys(ctx, "bots").Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(bots)
+	return bots, nil
+}
+
+func (r *Resolver) isBot(ctx context.Context, user string) (bool, error) {
+	if !isBotName(user) {
+		return false, nil
+	}
+	return r.redis.HExists(ctx, "bots", user).Result()
+}
+
+// createBot registers a bot account and returns its name
+func (r *Resolver) createBot(ctx context.Context, name string) (string, error) {
+	name = strings.TrimSuffix(name, botSuffix)
+	if !botName.MatchString(name) {
+		return "", errors.New("bot names may only contain letters, digits and dashes")
+	}
+	bot := name + botSuffix
+
+	actor := ClientFromContext(ctx).User
+	created, err := r.redis.HSetNX(ctx, "bots", bot, actor).Result()
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		return "", fmt.Errorf("bot %s already exists", bot)
+	}
+	r.audit.Record(ctx, "BOT_CREATED", actor, bot, "")
+	return bot, nil
+}
+
+// deleteBot removes a bot account together with its access tokens
+func (r *Resolver) deleteBot(ctx context.Context, bot string) error {
+	if ok, err := r.isBot(ctx, bot); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("unknown bot %q", bot)
+		}
+		return err
+	}
+
+	tokens, err := r.accessTokens(ctx, bot)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if err := r.revokeAccessToken(ctx, token); err != nil {
+			return err
+		}
+	}
+	if err := r.redis.HDel(ctx, "bots", bot).Err(); err != nil {
+		return err
+	}
+	r.disconnectUser(bot)
+	r.audit.Record(ctx, "BOT_DELETED", ClientFromContext(ctx).User, bot, "")
+	return nil
+}
+
+// authenticate replaces the session cookie's identity with that of the
+// access token in the Authorization header, if there is one. Requests with
+// an invalid token are rejected rather than treated as anonymous, so clients
+// notice when their token is revoked.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := ClientFromContext(r.Context())
+		// Bots only sign in with access tokens
+		if isBotName(client.User) {
+			client.User = ""
+		}
+
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := s.resolver.authenticateToken(r.Context(), authorization)
+		if err != nil {
+			status, gqlErr := http.StatusUnauthorized, invalidTokenError()
+			if errors.Is(err, errInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			} else {
+				slog.ErrorContext(r.Context(), "Failed to look up access token", "error", err)
+				status, gqlErr = http.StatusServiceUnavailable, gqlerror.Errorf("authentication is unavailable")
+			}
+			writeAuthError(w, r, status, gqlErr)
+			return
+		}
+
+		client.User = token.User
+		client.Token = token
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAuthError answers in the error format of the API that was called
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, err *gqlerror.Error) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		code, _ := err.Extensions["code"].(string)
+		if code == "" {
+			code = "INTERNAL"
+		}
+		writeAPIError(w, status, apiError{Code: code, Message: err.Message})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(graphql.Response{Errors: gqlerror.List{err}})
+}
+
+// TokenScopes is a gqlgen extension that limits what callers authenticated
+// with an access token may run. READ allows queries and subscriptions, POST
+// the postMessage mutation and ADMIN everything else. Browser sessions are
+// unrestricted, roles still apply to both and admin roles need the ADMIN
+// scope, see hasRole.
+type TokenScopes struct{}
+
+var _ interface {
+	graphql.HandlerExtension
+	graphql.OperationContextMutator
+} = TokenScopes{}
+
+func (TokenScopes) ExtensionName() string {
+	return "TokenScopes"
+}
+
+func (TokenScopes) Validate(schema graphql.ExecutableSchema) error {
+	return nil
+}
+
+func (TokenScopes) MutateOperationContext(ctx context.Context, rc *graphql.OperationContext) *gqlerror.Error {
+	client := ClientFromContext(ctx)
+	if client.Token == nil || rc.Operation == nil {
+		return nil
+	}
+	// Collecting the fields resolves fragments, which could hide a mutation
+	// from a plain look at the selection set
+	for _, field := range graphql.CollectFields(rc, rc.Operation.SelectionSet, nil) {
+		if strings.HasPrefix(field.Name, "__") {
+			continue
+		}
+		scope := requiredScope(rc.Operation.Operation, field.Name)
+		if !client.HasScope(scope) {
+			return scopeError(scope, field.Name)
+		}
+	}
+	return nil
+}
+
+// requiredScope returns the scope an access token needs for a root field
+func requiredScope(op ast.Operation, field string) TokenScope {
+	switch {
+	case op != ast.Mutation:
+		return TokenScopeRead
+	case field == "postMessage":
+		return TokenScopePost
+	default:
+		return TokenScopeAdmin
+	}
+}
+
+func scopeError(scope TokenScope, action string) *gqlerror.Error {
+	return &gqlerror.Error{
+		Message:    fmt.Sprintf("access token lacks the %s scope required for %s", strings.ToLower(scope.String()), action),
+		Extensions: map[string]interface{}{"code": "FORBIDDEN"},
+	}
+}
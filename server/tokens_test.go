@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newToken creates an access token for user and returns its secret
+func newToken(t *testing.T, s *Server, user string, scopes ...TokenScope) (*AccessToken, string) {
+	t.Helper()
+	created, err := s.resolver.createAccessToken(context.Background(), user, "test", scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return created.AccessToken, created.Token
+}
+
+// doWithToken posts query with an Authorization header and no cookies
+func doWithToken(t *testing.T, s *Server, secret, query string, variables map[string]interface{}) (int, *graphqlResult) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+
+	var result graphqlResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body, err)
+	}
+	return rec.Code, &result
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	_, secret := newToken(t, s, "alice", TokenScopeRead)
+
+	status, result := doWithToken(t, s, secret, `{ accessTokens { user } }`, nil)
+	if status != http.StatusOK || len(result.Errors) > 0 || !strings.Contains(string(result.Data), `"user":"alice"`) {
+		t.Errorf("valid token: %d %s %v", status, result.Data, result.Errors)
+	}
+
+	for _, invalid := range []string{"rtc_unknown", "not-a-token", secret + "x"} {
+		req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"query":"{ hello }"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+invalid)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "invalid_token") {
+			t.Errorf("token %q: status %d, WWW-Authenticate %q", invalid, rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.OwnerUsers = []string{"owner"}
+	})
+	_, read := newToken(t, s, "owner", TokenScopeRead)
+	_, post := newToken(t, s, "owner", TokenScopePost)
+	_, admin := newToken(t, s, "owner", TokenScopeAdmin)
+
+	const (
+		query      = `{ messages { id } }`
+		adminQuery = `{ moderationQueue { id } }`
+		mutation   = `mutation { blockUser(user: "bob") }`
+	)
+	postVariables := map[string]interface{}{"user": "owner", "text": "posted with a token"}
+	tests := []struct {
+		name      string
+		secret    string
+		query     string
+		variables map[string]interface{}
+		allowed   bool
+	}{
+		{"read query", read, query, nil, true},
+		{"read post", read, postMessageMutation, postVariables, false},
+		{"read mutation", read, mutation, nil, false},
+		// The token belongs to an owner, but READ doesn't carry admin powers
+		{"read admin query", read, adminQuery, nil, false},
+		{"post query", post, query, nil, false},
+		{"post post", post, postMessageMutation, postVariables, true},
+		{"post mutation", post, mutation, nil, false},
+		{"admin admin query", admin, adminQuery, nil, true},
+		{"admin mutation", admin, mutation, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, result := doWithToken(t, s, tt.secret, tt.query, tt.variables)
+			if allowed := len(result.Errors) == 0; allowed != tt.allowed {
+				t.Errorf("allowed %v, want %v: %v", allowed, tt.allowed, result.Errors)
+			}
+			if !tt.allowed && result.errorCode() != "FORBIDDEN" {
+				t.Errorf("error code %q, want FORBIDDEN", result.errorCode())
+			}
+		})
+	}
+
+	// The audit log export needs the ADMIN scope as well
+	for secret, status := range map[string]int{read: http.StatusForbidden, admin: http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/audit.jsonl", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("audit export: status %d, want %d", rec.Code, status)
+		}
+	}
+}
+
+func TestRevokedTokenEndsSubscriptions(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	token, secret := newToken(t, s, "alice", TokenScopeRead)
+
+	conn := dialWebsocket(t, s, "graphql-transport-ws")
+	if err := conn.WriteJSON(wsMessage{Type: "connection_init", Payload: map[string]interface{}{"Authorization": "Bearer " + secret}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := readWebsocket(t, conn); err != nil || msg.Type != "connection_ack" {
+		t.Fatalf("got %+v, %v, want connection_ack", msg, err)
+	}
+	err := conn.WriteJSON(wsMessage{ID: "1", Type: "subscribe", Payload: map[string]interface{}{
+		"query": `subscription { messagePosted(user: "alice") { text } }`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepPosting(t, s)
+	if msg, err := readWebsocket(t, conn); err != nil || msg.Type != "next" {
+		t.Fatalf("got %+v, %v, want next", msg, err)
+	}
+
+	if err := s.resolver.revokeAccessToken(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := readWebsocket(t, conn)
+		if err != nil {
+			t.Fatalf("connection ended without complete: %v", err)
+		}
+		if msg.Type == "complete" && msg.ID == "1" {
+			break
+		}
+	}
+
+	if status, _ := doWithToken(t, s, secret, `{ hello }`, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", status)
+	}
+}
+
+func TestBotNames(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	ctx := context.Background()
+
+	bot, err := s.resolver.createBot(ctx, "deploys")
+	if err != nil || bot != "deploys"+botSuffix {
+		t.Fatalf("createBot = %q, %v, want deploys%s", bot, err, botSuffix)
+	}
+	// The suffix is optional and names are unique
+	if _, err := s.resolver.createBot(ctx, "deploys"+botSuffix); err == nil {
+		t.Error("created deploys[bot] twice")
+	}
+	for _, name := range []string{"", "has space", "-dash", "semi;colon", strings.Repeat("a", 40)} {
+		if _, err := s.resolver.createBot(ctx, name); err == nil {
+			t.Errorf("created bot %q", name)
+		}
+	}
+
+	// Bots act through tokens, their messages are marked
+	_, secret := newToken(t, s, bot, TokenScopePost)
+	_, result := doWithToken(t, s, secret, `mutation($user: String!) { postMessage(user: $user, text: "deployed") { user isBot } }`,
+		map[string]interface{}{"user": bot})
+	if len(result.Errors) > 0 || string(result.Data) != `{"postMessage":{"user":"deploys[bot]","isBot":true}}` {
+		t.Errorf("bot post: %s %v", result.Data, result.Errors)
+	}
+
+	// A session cookie can't claim to be a bot
+	result = doGraphQL(t, s, postMessageMutation, map[string]interface{}{"user": bot, "text": "not a bot"}, sessionFor(s, bot))
+	if code := result.errorCode(); code != "UNAUTHORIZED" && code != "FORBIDDEN" {
+		t.Errorf("session as bot: error code %q", code)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testTracing installs a global provider that exports to memory. The package
+// tracer delegates to the first global provider for good, so it's installed
+// once for all tests.
+var testTracing = sync.OnceValues(func() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider, err := NewTracerProvider(exporter, "chat-test")
+	if err != nil {
+		panic(err)
+	}
+	otel.SetTracerProvider(provider)
+	return provider, exporter
+})
+
+func TestTracing(t *testing.T) {
+	provider, exporter := testTracing()
+
+	s, _ := newTestServer(t, nil)
+	postTestMessage(t, s, "alice", "traced message")
+	exporter.Reset()
+
+	result := doGraphQL(t, s, `query Latest { messages { id user } }`, nil, sessionFor(s, "alice"))
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	attributes := func(span tracetest.SpanStub) map[attribute.Key]string {
+		values := map[attribute.Key]string{}
+		for _, kv := range span.Attributes {
+			values[kv.Key] = kv.Value.Emit()
+		}
+		return values
+	}
+
+	request, ok := spans["POST /graphql"]
+	if !ok {
+		t.Fatalf("no request span in %v", spanNames(spans))
+	}
+	if service, _ := request.Resource.Set().Value("service.name"); service.AsString() != "chat-test" {
+		t.Errorf("service.name %q", service.AsString())
+	}
+
+	operation, ok := spans["graphql.query Latest"]
+	if !ok {
+		t.Fatalf("no operation span in %v", spanNames(spans))
+	}
+	if attrs := attributes(operation); attrs["graphql.operation.type"] != "query" || attrs["graphql.operation.name"] != "Latest" {
+		t.Errorf("operation attributes %v", attrs)
+	}
+	if operation.Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Error("operation span isn't a child of the request span")
+	}
+
+	field, ok := spans["Query.messages"]
+	if !ok {
+		t.Fatalf("no resolver span in %v", spanNames(spans))
+	}
+	if attrs := attributes(field); attrs["graphql.field.path"] != "messages" {
+		t.Errorf("field attributes %v", attrs)
+	}
+	if field.Parent.SpanID() != operation.SpanContext.SpanID() {
+		t.Error("resolver span isn't a child of the operation span")
+	}
+	// Plain struct fields aren't traced
+	if _, ok := spans["Message.id"]; ok {
+		t.Error("Message.id was traced")
+	}
+
+	// Background work of the earlier post may still add spans to other traces
+	redisSpans := 0
+	for _, span := range exporter.GetSpans() {
+		if attributes(span)["db.system"] == "redis" && span.SpanContext.TraceID() == request.SpanContext.TraceID() {
+			redisSpans++
+		}
+	}
+	if redisSpans == 0 {
+		t.Errorf("no Redis spans in the request's trace: %v", spanNames(spans))
+	}
+}
+
+func spanNames(spans map[string]tracetest.SpanStub) []string {
+	names := make([]string, 0, len(spans))
+	for name := range spans {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/net/html"
+)
+
+const (
+	maxPreviewsPerMessage = 3
+	maxUnfurlBodySize     = 1 << 20
+	unfurlTimeout         = 5 * time.Second
+	unfurlCacheTTL        = 24 * time.Hour
+	unfurlFailureTTL      = time.Hour
+)
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// LinkPreview holds the OpenGraph/oEmbed metadata of a URL posted in a message
+type LinkPreview struct {
+	URL         string  `json:"url"`
+	Title       *string `json:"title,omitempty"`
+	Description *string `json:"description,omitempty"`
+	ImageURL    *string `json:"imageUrl,omitempty"`
+	SiteName    *string `json:"siteName,omitempty"`
+}
+
+func (p *LinkPreview) empty() bool {
+	return p.Title == nil && p.Description == nil && p.ImageURL == nil
+}
+
+// Unfurler fetches link previews for URLs found in messages
+type Unfurler struct {
+	redis  *redis.Client
+	client *http.Client
+}
+
+func NewUnfurler(redisClient *redis.Client) *Unfurler {
+	return newUnfurler(redisClient, false)
+}
+
+// newUnfurler optionally allows private addresses so tests can use httptest servers
+func newUnfurler(redisClient *redis.Client, allowPrivate bool) *Unfurler {
+	dialer := publicDialer(unfurlTimeout, allowPrivate)
+	return &Unfurler{
+		redis: redisClient,
+		client: &http.Client{
+			Timeout: unfurlTimeout,
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   unfurlTimeout,
+				ResponseHeaderTimeout: unfurlTimeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       30 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("unsupported redirect scheme %q", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// publicDialer returns a dialer that refuses private and loopback addresses
+// unless allowPrivate is set. The resolved address of every connection is
+// checked, including redirects, so DNS tricks can't be used to reach
+// internal services.
+func publicDialer(timeout time.Duration, allowPrivate bool) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if allowPrivate {
+		return dialer
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || isPrivateIP(ip) {
+			return fmt.Errorf("refusing to connect to %s", host)
+		}
+		return nil
+	}
+	return dialer
+}
+
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractURLs returns the distinct http(s) URLs in a message text
+func extractURLs(text string) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		match = strings.TrimRight(match, ".,;:!?)]}")
+		if seen[match] {
+			continue
+		}
+		seen[match] = true
+		urls = append(urls, match)
+		if len(urls) == maxPreviewsPerMessage {
+			break
+		}
+	}
+	return urls
+}
+
+// Unfurl returns the previews for all URLs in text, skipping any that fail
+func (u *Unfurler) Unfurl(ctx context.Context, text string) []*LinkPreview {
+	var previews []*LinkPreview
+	for _, rawURL := range extractURLs(text) {
+		preview, err := u.preview(ctx, rawURL)
+		if err != nil {
+			slog.Debug("Failed to unfurl link", "url", rawURL, "error", err)
+			continue
+		}
+		if preview != nil {
+			previews = append(previews, preview)
+		}
+	}
+	return previews
+}
+
+func unfurlCacheKey(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return "unfurl:" + hex.EncodeToString(sum[:])
+}
+
+// preview returns a cached preview or fetches a new one. Failures are cached
+// as empty previews so a broken link isn't fetched on every post.
+func (u *Unfurler) preview(ctx context.Context, rawURL string) (*LinkPreview, error) {
+	key := unfurlCacheKey(rawURL)
+	if cached, err := u.redis.Get(ctx, key).Result(); err == nil {
+		var preview LinkPreview
+		if err := json.Unmarshal([]byte(cached), &preview); err == nil {
+			if preview.empty() {
+				return nil, nil
+			}
+			return &preview, nil
+		}
+	}
+
+	preview, fetchErr := u.fetch(ctx, rawURL)
+	ttl := unfurlCacheTTL
+	if fetchErr != nil || preview.empty() {
+		preview = &LinkPreview{URL: rawURL}
+		ttl = unfurlFailureTTL
+	}
+	if previewJSON, err := json.Marshal(preview); err == nil {
+		u.redis.Set(ctx, key, previewJSON, ttl)
+	}
+
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if preview.empty() {
+		return nil, nil
+	}
+	return preview, nil
+}
+
+func (u *Unfurler) fetch(ctx context.Context, rawURL string) (*LinkPreview, error) {
+	pageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := u.get(ctx, pageURL.String(), "text/html", "application/xhtml+xml")
+	if err != nil {
+		return nil, err
+	}
+
+	preview, oembedURL := parseOpenGraph(body, pageURL)
+	if preview.Title == nil && oembedURL != "" {
+		if err := u.fetchOEmbed(ctx, pageURL, oembedURL, preview); err != nil {
+			slog.Debug("Failed to fetch oEmbed", "url", rawURL, "error", err)
+		}
+	}
+	return preview, nil
+}
+
+func (u *Unfurler) get(ctx context.Context, rawURL string, accept ...string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "go-realtime-chat-unfurler/1.0")
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !slices.Contains(accept, contentType) {
+		return "", fmt.Errorf("unexpected content type %q", contentType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUnfurlBodySize))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// parseOpenGraph reads og:* and standard meta tags and returns the oEmbed
+// discovery URL, if the page advertises one. Twitter card tags, then <title>
+// and the description meta tag, fill in what OpenGraph leaves out.
+func parseOpenGraph(body string, pageURL *url.URL) (*LinkPreview, string) {
+	preview := &LinkPreview{URL: pageURL.String()}
+	var title, description, oembedURL string
+	twitter := &LinkPreview{}
+	finish := func() (*LinkPreview, string) {
+		if preview.Title == nil {
+			preview.Title = twitter.Title
+		}
+		if preview.Title == nil && title != "" {
+			preview.Title = &title
+		}
+		if preview.Description == nil {
+			preview.Description = twitter.Description
+		}
+		if preview.Description == nil && description != "" {
+			preview.Description = &description
+		}
+		if preview.ImageURL == nil {
+			preview.ImageURL = twitter.ImageURL
+		}
+		return preview, oembedURL
+	}
+
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return finish()
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == "title" {
+				inTitle = false
+				title = strings.TrimSpace(title)
+			}
+			if string(name) == "head" {
+				return finish()
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = tokenizer.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "meta":
+				property := attrs["property"]
+				if property == "" {
+					property = attrs["name"]
+				}
+				content := strings.TrimSpace(attrs["content"])
+				if content == "" {
+					continue
+				}
+				switch property {
+				case "og:title":
+					preview.Title = &content
+				case "og:description":
+					preview.Description = &content
+				case "description":
+					description = content
+				case "og:site_name":
+					preview.SiteName = &content
+				case "og:image", "og:image:url":
+					if preview.ImageURL == nil {
+						if imageURL := resolveURL(pageURL, content); imageURL != "" {
+							preview.ImageURL = &imageURL
+						}
+					}
+				case "twitter:title":
+					twitter.Title = &content
+				case "twitter:description":
+					twitter.Description = &content
+				case "twitter:image", "twitter:image:src":
+					if twitter.ImageURL == nil {
+						if imageURL := resolveURL(pageURL, content); imageURL != "" {
+							twitter.ImageURL = &imageURL
+						}
+					}
+				}
+			case "link":
+				if attrs["rel"] == "alternate" && attrs["type"] == "application/json+oembed" {
+					oembedURL = resolveURL(pageURL, attrs["href"])
+				}
+			}
+		}
+	}
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+// fetchOEmbed fills in what the page's Open Graph tags left out from its
+// oEmbed endpoint
+func (u *Unfurler) fetchOEmbed(ctx context.Context, pageURL *url.URL, oembedURL string, preview *LinkPreview) error {
+	body, err := u.get(ctx, oembedURL, "application/json", "text/json")
+	if err != nil {
+		return err
+	}
+
+	var oembed struct {
+		Title        string `json:"title"`
+		ProviderName string `json:"provider_name"`
+		ThumbnailURL string `json:"thumbnail_url"`
+	}
+	if err := json.Unmarshal([]byte(body), &oembed); err != nil {
+		return err
+	}
+
+	if oembed.Title != "" {
+		preview.Title = &oembed.Title
+	}
+	if oembed.ProviderName != "" && preview.SiteName == nil {
+		preview.SiteName = &oembed.ProviderName
+	}
+	// Like og:image, the thumbnail may be relative or use another scheme
+	if oembed.ThumbnailURL != "" && preview.ImageURL == nil {
+		if imageURL := resolveURL(pageURL, oembed.ThumbnailURL); imageURL != "" {
+			preview.ImageURL = &imageURL
+		}
+	}
+	return nil
+}
+
+// unfurlMessage attaches link previews to a stored message and broadcasts
+// the update. It runs in the background after the message was posted.
+func (r *Resolver) unfurlMessage(ctx context.Context, msg *Message) {
+	if r.unfurler == nil || len(extractURLs(msg.Text)) == 0 {
+		return
+	}
+
+	ctx, span := tracer.Start(ctx, "unfurl")
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, maxPreviewsPerMessage*unfurlTimeout*2)
+	defer cancel()
+
+	previews := r.unfurler.Unfurl(ctx, msg.Text)
+	if len(previews) == 0 {
+		return
+	}
+
+	// The message may have been hidden or deleted while the previews were
+	// fetched, so only the previews are merged into the stored version
+	updated, err := r.updateMessage(ctx, msg.ID, func(stored *Message) {
+		stored.LinkPreviews = previews
+	})
+	if errors.Is(err, errMessageNotFound) {
+		slog.DebugContext(ctx, "Message was deleted before its link previews were ready", "message", msg.ID)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save link previews to Redis", "message", msg.ID, "error", err)
+		return
+	}
+	if updated.Hidden {
+		return
+	}
+
+	r.broadcastUpdate(ctx, updated)
+}
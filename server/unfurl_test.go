@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPage = `<html><head>
+<meta property="og:title" content="Example title">
+<meta property="og:description" content="Example description">
+</head></html>`
+
+func TestUnfurlMergesPreviewsIntoStoredMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		// during runs while the preview is fetched
+		during func(r *Resolver, msg *Message) error
+		check  func(t *testing.T, stored *Message, err error)
+	}{
+		{
+			name: "hidden",
+			during: func(r *Resolver, msg *Message) error {
+				return r.hideMessage(context.Background(), msg)
+			},
+			check: func(t *testing.T, stored *Message, err error) {
+				if err != nil || !stored.Hidden || len(stored.LinkPreviews) != 1 {
+					t.Errorf("stored %+v, %v, want hidden with a preview", stored, err)
+				}
+			},
+		},
+		{
+			name: "deleted",
+			during: func(r *Resolver, msg *Message) error {
+				return r.deleteMessage(context.Background(), msg)
+			},
+			check: func(t *testing.T, stored *Message, err error) {
+				if err == nil {
+					t.Errorf("deleted message was stored again: %+v", stored)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+			r := s.resolver
+			r.unfurler = newUnfurler(s.redis, true)
+
+			var msg *Message
+			page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := tt.during(r, msg); err != nil {
+					t.Error(err)
+				}
+				w.Header().Set("Content-Type", "text/html")
+				fmt.Fprint(w, testPage)
+			}))
+			defer page.Close()
+
+			id := postTestMessage(t, s, "alice", "have a look")
+			msg, _ = r.loadMessage(context.Background(), id)
+
+			updates, err := r.subscribe(context.Background(), "updated", "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			posted := *msg
+			posted.Text = "have a look " + page.URL
+			r.unfurlMessage(context.Background(), &posted)
+
+			stored, err := r.loadMessage(context.Background(), id)
+			tt.check(t, stored, err)
+
+			// Only the redacted update of hiding or deleting is broadcast,
+			// never the message with its previews
+			for len(updates) > 0 {
+				if update := <-updates; update.Text != "" || !update.Hidden {
+					t.Errorf("broadcast %+v", update)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateMessageNotFound(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	_, err := s.resolver.updateMessage(context.Background(), "missing", func(*Message) {})
+	if !errors.Is(err, errMessageNotFound) {
+		t.Errorf("err = %v, want errMessageNotFound", err)
+	}
+}
+
+func TestParseOpenGraph(t *testing.T) {
+	pageURL, _ := url.Parse("https://example.com/posts/1")
+	tests := []struct {
+		name        string
+		head        string
+		title       string
+		description string
+		image       string
+		oembed      string
+	}{
+		{
+			name:        "opengraph",
+			head:        testPage + `<meta property="og:image" content="/cover.png">`,
+			title:       "Example title",
+			description: "Example description",
+		},
+		{
+			name: "opengraph image",
+			head: `<meta property="og:title" content="Example title">
+				<meta property="og:image" content="/cover.png">
+				<meta property="og:image" content="/second.png">`,
+			title: "Example title",
+			image: "https://example.com/cover.png",
+		},
+		{
+			name: "twitter card",
+			head: `<meta name="twitter:title" content="Card title">
+				<meta name="twitter:description" content="Card description">
+				<meta name="twitter:image" content="https://cdn.example.com/card.png">`,
+			title:       "Card title",
+			description: "Card description",
+			image:       "https://cdn.example.com/card.png",
+		},
+		{
+			name: "opengraph before twitter",
+			head: `<meta name="twitter:title" content="Card title">
+				<meta name="twitter:image" content="/card.png">
+				<meta property="og:title" content="Example title">
+				<meta property="og:image" content="/cover.png">`,
+			title: "Example title",
+			image: "https://example.com/cover.png",
+		},
+		{
+			name: "twitter before plain tags",
+			head: `<title> Page title </title>
+				<meta name="description" content="Meta description">
+				<meta name="twitter:description" content="Card description">`,
+			title:       "Page title",
+			description: "Card description",
+		},
+		{
+			name:        "plain tags",
+			head:        `<title>Page title</title><meta name="description" content="Meta description">`,
+			title:       "Page title",
+			description: "Meta description",
+		},
+		{
+			name:  "unsafe image",
+			head:  `<meta property="og:title" content="Example title"><meta name="twitter:image" content="javascript:alert(1)">`,
+			title: "Example title",
+		},
+		{
+			name:   "oembed",
+			head:   `<link rel="alternate" type="application/json+oembed" href="/oembed?url=1">`,
+			oembed: "https://example.com/oembed?url=1",
+		},
+		{
+			name: "body is ignored",
+			head: `</head><body><meta property="og:title" content="Late title">`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview, oembed := parseOpenGraph("<html><head>"+tt.head+"</head></html>", pageURL)
+			value := func(s *string) string {
+				if s == nil {
+					return ""
+				}
+				return *s
+			}
+			if got := value(preview.Title); got != tt.title {
+				t.Errorf("title %q, want %q", got, tt.title)
+			}
+			if got := value(preview.Description); got != tt.description {
+				t.Errorf("description %q, want %q", got, tt.description)
+			}
+			if got := value(preview.ImageURL); got != tt.image {
+				t.Errorf("image %q, want %q", got, tt.image)
+			}
+			if oembed != tt.oembed {
+				t.Errorf("oEmbed %q, want %q", oembed, tt.oembed)
+			}
+		})
+	}
+}
+
+func TestUnfurlLimits(t *testing.T) {
+	padding := strings.Repeat("<!-- padding -->", maxUnfurlBodySize/16+1)
+	var requests atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/page":
+			fmt.Fprint(w, testPage)
+		case "/oembed-page":
+			fmt.Fprint(w, `<html><head><link rel="alternate" type="application/json+oembed" href="/oembed"></head></html>`)
+		case "/oembed":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"title": "Embedded title", "provider_name": "Example"}`)
+		case "/large-head":
+			// The tags are past the size limit and never read
+			fmt.Fprint(w, "<html><head>"+padding+testPage)
+		case "/large-body":
+			fmt.Fprint(w, testPage+padding)
+		case "/slow":
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"title": "Not a page"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	s, _ := newTestServer(t, nil)
+	unfurler := newUnfurler(s.redis, true)
+	unfurler.client.Timeout = 200 * time.Millisecond
+
+	tests := []struct {
+		path  string
+		title string
+	}{
+		{"/page", "Example title"},
+		{"/oembed-page", "Embedded title"},
+		{"/large-head", ""},
+		{"/large-body", "Example title"},
+		{"/slow", ""},
+		{"/json", ""},
+		{"/missing", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			start := time.Now()
+			previews := unfurler.Unfurl(context.Background(), "look at "+site.URL+tt.path+".")
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %s", elapsed)
+			}
+			title := ""
+			if len(previews) == 1 {
+				title = *previews[0].Title
+			} else if len(previews) > 1 {
+				t.Fatalf("got %d previews", len(previews))
+			}
+			if title != tt.title {
+				t.Errorf("title %q, want %q", title, tt.title)
+			}
+
+			// Previews and failures are cached
+			fetched := requests.Load()
+			unfurler.Unfurl(context.Background(), site.URL+tt.path)
+			if requests.Load() != fetched {
+				t.Error("fetched again instead of using the cache")
+			}
+		})
+	}
+}
+
+func TestUnfurlRefusesPrivateAddresses(t *testing.T) {
+	var requests atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testPage)
+	}))
+	defer site.Close()
+
+	s, _ := newTestServer(t, nil)
+	unfurler := newUnfurler(s.redis, false)
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(site.URL, "http://"))
+	for _, host := range []string{"127.0.0.1", "localhost", "[::ffff:127.0.0.1]"} {
+		if previews := unfurler.Unfurl(context.Background(), "http://"+host+":"+port+"/page"); len(previews) > 0 {
+			t.Errorf("%s: got %+v", host, previews[0])
+		}
+	}
+	if n := requests.Load(); n > 0 {
+		t.Errorf("%d requests reached the private server", n)
+	}
+
+	tests := map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.20.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"::ffff:10.0.0.1": true,
+		"93.184.216.34":   false,
+		"2606:4700::1111": false,
+		"172.32.0.1":      false,
+		"::ffff:1.1.1.1":  false,
+	}
+	for address, private := range tests {
+		if got := isPrivateIP(net.ParseIP(address)); got != private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", address, got, private)
+		}
+	}
+}
+
+func TestOEmbedThumbnail(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oembed" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"title": "Embedded title", "thumbnail_url": %q}`, r.URL.Query().Get("thumbnail"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<html><head><link rel="alternate" type="application/json+oembed" href="/oembed?thumbnail=%s"></head></html>`,
+			url.QueryEscape(r.URL.Query().Get("thumbnail")))
+	}))
+	defer site.Close()
+
+	s, _ := newTestServer(t, nil)
+	unfurler := newUnfurler(s.redis, true)
+
+	tests := []struct {
+		thumbnail string
+		imageURL  string
+	}{
+		{"https://cdn.example.com/thumb.png", "https://cdn.example.com/thumb.png"},
+		{"/thumb.png", site.URL + "/thumb.png"},
+		{"javascript:alert(1)", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.thumbnail, func(t *testing.T) {
+			previews := unfurler.Unfurl(context.Background(), site.URL+"/page?thumbnail="+url.QueryEscape(tt.thumbnail))
+			if len(previews) != 1 {
+				t.Fatalf("got %d previews", len(previews))
+			}
+			imageURL := ""
+			if previews[0].ImageURL != nil {
+				imageURL = *previews[0].ImageURL
+			}
+			if imageURL != tt.imageURL {
+				t.Errorf("image URL %q, want %q", imageURL, tt.imageURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,486 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	webhookTimeout     = 10 * time.Second
+	maxWebhookAttempts = 5
+	// webhookBackoff is the delay before the first retry, it doubles for
+	// every further one
+	webhookBackoff = 2 * time.Second
+
+	maxWebhooks           = 20
+	maxWebhookURLLength   = 2048
+	maxWebhookDeliveries  = 100
+	maxWebhookDeadLetters = 1000
+
+	webhookSecretPrefix   = "whsec_"
+	webhookDeadLettersKey = "webhook_dead_letters"
+)
+
+// Webhook receives chat events as signed POST requests
+type Webhook struct {
+	ID        string         `json:"id"`
+	URL       string         `json:"url"`
+	Events    []WebhookEvent `json:"events"`
+	Room      *string        `json:"room,omitempty"`
+	CreatedBy string         `json:"createdBy"`
+	CreatedAt Time           `json:"createdAt"`
+	Secret    string         `json:"secret"`
+}
+
+func (h *Webhook) wants(event WebhookEvent, room string) bool {
+	return slices.Contains(h.Events, event) && (h.Room == nil || *h.Room == room)
+}
+
+// WebhookDelivery is the log entry of one delivery attempt
+type WebhookDelivery struct {
+	ID         string       `json:"id"`
+	DeliveryID string       `json:"deliveryId"`
+	WebhookID  string       `json:"webhookId"`
+	Event      WebhookEvent `json:"event"`
+	Attempt    int          `json:"attempt"`
+	StatusCode *int         `json:"statusCode,omitempty"`
+	Error      *string      `json:"error,omitempty"`
+	DurationMs int          `json:"durationMs"`
+	Success    bool         `json:"success"`
+	CreatedAt  Time         `json:"createdAt"`
+}
+
+// webhookPayload is the body of every delivery
+type webhookPayload struct {
+	ID        string       `json:"id"`
+	Event     WebhookEvent `json:"event"`
+	Room      string       `json:"room"`
+	CreatedAt Time         `json:"createdAt"`
+	Data      interface{}  `json:"data"`
+}
+
+// webhookDeadLetter keeps an event that couldn't be delivered so it can be
+// inspected or replayed by hand
+type webhookDeadLetter struct {
+	DeliveryID string          `json:"deliveryId"`
+	WebhookID  string          `json:"webhookId"`
+	URL        string          `json:"url"`
+	Event      WebhookEvent    `json:"event"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error"`
+	Payload    json.RawMessage `json:"payload"`
+	FailedAt   Time            `json:"failedAt"`
+}
+
+func webhookDeliveriesKey(id string) string {
+	return "webhook_deliveries:" + id
+}
+
+// Webhooks stores the registered webhooks and delivers events to them in the
+// background. Failed deliveries are retried with exponential backoff and end
+// up in the dead letter list once every attempt failed.
+type Webhooks struct {
+	redis   *redis.Client
+	client  *http.Client
+	backoff time.Duration
+
+	// ctx is cancelled by Close to stop waiting for retries
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWebhooks creates the webhook dispatcher. Receivers on private and
+// loopback addresses are refused unless allowPrivate is set.
+func NewWebhooks(redisClient *redis.Client, allowPrivate bool) *Webhooks {
+	return newWebhooks(redisClient, allowPrivate, webhookBackoff)
+}
+
+// newWebhooks takes a shorter backoff so tests with httptest receivers don't
+// wait for retries
+func newWebhooks(redisClient *redis.Client, allowPrivate bool, backoff time.Duration) *Webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Webhooks{
+		redis: redisClient,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext:           publicDialer(webhookTimeout, allowPrivate).DialContext,
+				TLSHandshakeTimeout:   webhookTimeout,
+				ResponseHeaderTimeout: webhookTimeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       30 * time.Second,
+			},
+			// A redirect would resend the signed body somewhere else
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		backoff: backoff,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Close stops retrying and waits for deliveries in flight, which are moved to
+// the dead letter list if they haven't succeeded yet
+func (w *Webhooks) Close(ctx context.Context) error {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *Webhooks) List(ctx context.Context) ([]*Webhook, error) {
+	values, err := w.redis.HVals(ctx, "webhooks").Result()
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]*Webhook, 0, len(values))
+	for _, value := range values {
+		var hook Webhook
+		if err := json.Unmarshal([]byte(value), &hook); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, &hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
+
+func (w *Webhooks) Get(ctx context.Context, id string) (*Webhook, error) {
+	value, err := w.redis.HGet(ctx, "webhooks", id).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("unknown webhook %q", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hook Webhook
+	if err := json.Unmarshal([]byte(value), &hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+// Create registers a webhook and returns it with its signing secret
+func (w *Webhooks) Create(ctx context.Context, rawURL string, events []WebhookEvent, room *string) (*NewWebhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || len(rawURL) > maxWebhookURLLength {
+		return nil, errors.New("url must be an absolute http or https URL")
+	}
+	events = slices.Clone(events)
+	slices.Sort(events)
+	events = slices.Compact(events)
+	if len(events) == 0 {
+		return nil, errors.New("at least one event is required")
+	}
+	if slices.Contains(events, WebhookEventPing) {
+		return nil, errors.New("PING is only sent by testWebhook")
+	}
+	if room != nil && *room != defaultRoom {
+		return nil, fmt.Errorf("unknown room %q", *room)
+	}
+
+	count, err := w.redis.HLen(ctx, "webhooks").Result()
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxWebhooks {
+		return nil, fmt.Errorf("there are already %d webhooks, delete one first", count)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	hook := &Webhook{
+		ID:        ksuid.New().String(),
+		URL:       rawURL,
+		Events:    events,
+		Room:      room,
+		CreatedBy: ClientFromContext(ctx).User,
+		CreatedAt: Time{Time: time.Now()},
+		Secret:    webhookSecretPrefix + base64.RawURLEncoding.EncodeToString(b),
+	}
+	hookJSON, err := json.Marshal(hook)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.redis.HSet(ctx, "webhooks", hook.ID, hookJSON).Err(); err != nil {
+		return nil, err
+	}
+	return &NewWebhook{Webhook: hook, Secret: hook.Secret}, nil
+}
+
+// Delete removes a webhook and its delivery log. Deliveries already in
+// flight are still attempted.
+func (w *Webhooks) Delete(ctx context.Context, id string) error {
+	pipe := w.redis.TxPipeline()
+	deleted := pipe.HDel(ctx, "webhooks", id)
+	pipe.Del(ctx, webhookDeliveriesKey(id))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if deleted.Val() == 0 {
+		return fmt.Errorf("unknown webhook %q", id)
+	}
+	return nil
+}
+
+// Deliveries returns the latest delivery attempts of a webhook, newest first
+func (w *Webhooks) Deliveries(ctx context.Context, id string, first int) ([]*WebhookDelivery, error) {
+	if first <= 0 || first > maxWebhookDeliveries {
+		first = maxWebhookDeliveries
+	}
+	values, err := w.redis.LRange(ctx, webhookDeliveriesKey(id), 0, int64(first)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*WebhookDelivery, 0, len(values))
+	for _, value := range values {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(value), &delivery); err != nil {
+			continue
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, nil
+}
+
+// Publish delivers an event to every webhook that subscribed to it. It
+// returns once the deliveries are started.
+func (w *Webhooks) Publish(ctx context.Context, event WebhookEvent, room string, data interface{}) {
+	if w == nil {
+		return
+	}
+	hooks, err := w.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load webhooks", "event", event, "error", err)
+		return
+	}
+
+	createdAt := Time{Time: time.Now()}
+	for _, hook := range hooks {
+		if !hook.wants(event, room) {
+			continue
+		}
+		payload := &webhookPayload{
+			ID:        ksuid.New().String(),
+			Event:     event,
+			Room:      room,
+			CreatedAt: createdAt,
+			Data:      data,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to marshal webhook payload", "event", event, "error", err)
+			continue
+		}
+
+		w.wg.Add(1)
+		go w.deliver(hook, payload.ID, event, body)
+	}
+}
+
+// Test sends a PING event once and returns the outcome
+func (w *Webhooks) Test(ctx context.Context, hook *Webhook) (*WebhookDelivery, error) {
+	payload := &webhookPayload{
+		ID:        ksuid.New().String(),
+		Event:     WebhookEventPing,
+		Room:      defaultRoom,
+		CreatedAt: Time{Time: time.Now()},
+		Data:      map[string]string{"webhookId": hook.ID},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	delivery, _ := w.attempt(ctx, hook, payload.ID, WebhookEventPing, 1, body)
+	return delivery, nil
+}
+
+// deliver attempts a delivery until it succeeds, fails permanently or runs
+// out of attempts
+func (w *Webhooks) deliver(hook *Webhook, deliveryID string, event WebhookEvent, body []byte) {
+	defer w.wg.Done()
+
+	var last *WebhookDelivery
+	for attempt := 1; attempt <= maxWebhookAttempts; attempt++ {
+		if attempt > 1 {
+			// Jitter keeps retries of many events from arriving at once
+			delay := w.backoff << (attempt - 2)
+			delay += time.Duration(mathrand.Int64N(int64(delay)/4 + 1))
+			select {
+			case <-time.After(delay):
+			case <-w.ctx.Done():
+				w.deadLetter(hook, deliveryID, event, body, attempt-1, "server shut down before the next retry")
+				return
+			}
+		}
+
+		delivery, retry := w.attempt(w.ctx, hook, deliveryID, event, attempt, body)
+		if delivery.Success {
+			return
+		}
+		last = delivery
+		if !retry {
+			break
+		}
+	}
+
+	w.deadLetter(hook, deliveryID, event, body, last.Attempt, deliveryFailure(last))
+}
+
+// deliveryFailure describes why an attempt failed
+func deliveryFailure(delivery *WebhookDelivery) string {
+	if delivery.Error != nil {
+		return *delivery.Error
+	}
+	if delivery.StatusCode != nil {
+		return fmt.Sprintf("status %d", *delivery.StatusCode)
+	}
+	return "unknown error"
+}
+
+// attempt posts the event once and logs the outcome. It reports whether a
+// failure is worth retrying.
+func (w *Webhooks) attempt(ctx context.Context, hook *Webhook, deliveryID string, event WebhookEvent, attempt int, body []byte) (*WebhookDelivery, bool) {
+	start := time.Now()
+	delivery := &WebhookDelivery{
+		ID:         ksuid.New().String(),
+		DeliveryID: deliveryID,
+		WebhookID:  hook.ID,
+		Event:      event,
+		Attempt:    attempt,
+		CreatedAt:  Time{Time: start},
+	}
+
+	retry := true
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err == nil {
+		timestamp := strconv.FormatInt(start.Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "graphql-realtime-chat-webhooks")
+		req.Header.Set("X-Webhook-Event", string(event))
+		req.Header.Set("X-Webhook-Delivery", deliveryID)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(hook.Secret, timestamp, body))
+
+		var resp *http.Response
+		resp, err = w.client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+
+			status := resp.StatusCode
+			delivery.StatusCode = &status
+			delivery.Success = status >= 200 && status < 300
+			// Other client errors won't go away by sending the same request
+			retry = status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+		}
+	}
+	if err != nil {
+		message := err.Error()
+		delivery.Error = &message
+	}
+	delivery.DurationMs = int(time.Since(start).Milliseconds())
+
+	result := "success"
+	if !delivery.Success {
+		result = "failure"
+		slog.WarnContext(ctx, "Webhook delivery failed", "webhook", hook.ID, "delivery", deliveryID, "attempt", attempt, "reason", deliveryFailure(delivery))
+	}
+	webhookDeliveries.WithLabelValues(result).Inc()
+
+	// The log is written even when the server is shutting down
+	logCtx := context.WithoutCancel(ctx)
+	if deliveryJSON, err := json.Marshal(delivery); err == nil {
+		pipe := w.redis.TxPipeline()
+		pipe.LPush(logCtx, webhookDeliveriesKey(hook.ID), deliveryJSON)
+		pipe.LTrim(logCtx, webhookDeliveriesKey(hook.ID), 0, maxWebhookDeliveries-1)
+		if _, err := pipe.Exec(logCtx); err != nil {
+			slog.ErrorContext(ctx, "Failed to log webhook delivery", "webhook", hook.ID, "error", err)
+		}
+	}
+	return delivery, retry
+}
+
+func (w *Webhooks) deadLetter(hook *Webhook, deliveryID string, event WebhookEvent, body []byte, attempts int, reason string) {
+	letter := &webhookDeadLetter{
+		DeliveryID: deliveryID,
+		WebhookID:  hook.ID,
+		URL:        hook.URL,
+		Event:      event,
+		Attempts:   attempts,
+		Error:      reason,
+		Payload:    body,
+		FailedAt:   Time{Time: time.Now()},
+	}
+	letterJSON, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	pipe := w.redis.TxPipeline()
+	pipe.LPush(ctx, webhookDeadLettersKey, letterJSON)
+	pipe.LTrim(ctx, webhookDeadLettersKey, 0, maxWebhookDeadLetters-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Failed to store webhook dead letter", "webhook", hook.ID, "delivery", deliveryID, "error", err)
+	}
+	webhookDeadLetters.Inc()
+	slog.Warn("Gave up on webhook delivery", "webhook", hook.ID, "delivery", deliveryID, "attempts", attempts, "error", reason)
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers
+// compute the same with their secret and compare it to X-Webhook-Signature.
+// The timestamp lets them reject old deliveries that are replayed.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// userJoined sends USER_JOINED the first time a user logs in
+func (r *Resolver) userJoined(ctx context.Context, user string) {
+	added, err := r.redis.SAdd(ctx, "users", user).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to record user", "user", user, "error", err)
+		return
+	}
+	if added > 0 {
+		r.webhooks.Publish(ctx, WebhookEventUserJoined, defaultRoom, map[string]string{"user": user})
+	}
+}
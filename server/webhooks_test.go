@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver answers deliveries with the next of statuses, repeating
+// the last one, and records the requests
+type webhookReceiver struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		status := receiver.statuses[min(len(receiver.requests), len(receiver.statuses)-1)]
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// publishTestEvent registers a webhook for receiver, publishes a message and
+// waits until every delivery succeeded or was given up
+func publishTestEvent(t *testing.T, receiver *webhookReceiver) (*Webhooks, *NewWebhook) {
+	t.Helper()
+	s, _ := newTestServer(t, nil)
+	webhooks := newWebhooks(s.redis, true, time.Millisecond)
+	ctx := context.Background()
+	hook, err := webhooks.Create(ctx, receiver.URL, []WebhookEvent{WebhookEventMessagePosted}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.Publish(ctx, WebhookEventMessagePosted, defaultRoom, &Message{ID: "1", User: "alice", Text: "hello"})
+	webhooks.wg.Wait()
+	return webhooks, hook
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	_, hook := publishTestEvent(t, receiver)
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(receiver.requests))
+	}
+	req, body := receiver.requests[0], receiver.bodies[0]
+	if req.Header.Get("X-Webhook-Event") != "MESSAGE_POSTED" || req.Header.Get("X-Webhook-Delivery") == "" {
+		t.Errorf("headers %v", req.Header)
+	}
+
+	timestamp := req.Header.Get("X-Webhook-Timestamp")
+	signature, ok := strings.CutPrefix(req.Header.Get("X-Webhook-Signature"), "sha256=")
+	if !ok || !hmac.Equal([]byte(signature), []byte(signWebhook(hook.Secret, timestamp, body))) {
+		t.Errorf("signature %q doesn't match the body", req.Header.Get("X-Webhook-Signature"))
+	}
+	if signature == signWebhook("whsec_other", timestamp, body) {
+		t.Error("signature doesn't depend on the secret")
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != WebhookEventMessagePosted || payload.ID != req.Header.Get("X-Webhook-Delivery") {
+		t.Errorf("payload %+v", payload)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		attempts   int
+		deadLetter bool
+	}{
+		{"success", []int{http.StatusOK}, 1, false},
+		{"server errors", []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, 3, false},
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusOK}, 2, false},
+		{"client error", []int{http.StatusBadRequest}, 1, true},
+		{"gone", []int{http.StatusGone, http.StatusOK}, 1, true},
+		{"always failing", []int{http.StatusServiceUnavailable}, maxWebhookAttempts, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(t, tt.statuses...)
+			webhooks, hook := publishTestEvent(t, receiver)
+			ctx := context.Background()
+
+			if len(receiver.requests) != tt.attempts {
+				t.Errorf("got %d requests, want %d", len(receiver.requests), tt.attempts)
+			}
+			// Every retry is the same delivery
+			for _, req := range receiver.requests {
+				if id := req.Header.Get("X-Webhook-Delivery"); id != receiver.requests[0].Header.Get("X-Webhook-Delivery") {
+					t.Errorf("delivery ID changed to %s", id)
+				}
+			}
+
+			// The log has every attempt, newest first
+			deliveries, err := webhooks.Deliveries(ctx, hook.Webhook.ID, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deliveries) != tt.attempts {
+				t.Fatalf("logged %d deliveries, want %d", len(deliveries), tt.attempts)
+			}
+			for i, delivery := range deliveries {
+				attempt := tt.attempts - i
+				status := tt.statuses[min(attempt-1, len(tt.statuses)-1)]
+				if delivery.Attempt != attempt || delivery.StatusCode == nil || *delivery.StatusCode != status {
+					t.Errorf("delivery %d: %+v, want attempt %d with status %d", i, delivery, attempt, status)
+				}
+				if delivery.Success != (status < 300) {
+					t.Errorf("delivery %d: success %v with status %d", i, delivery.Success, status)
+				}
+			}
+
+			letters, err := webhooks.redis.LRange(ctx, webhookDeadLettersKey, 0, -1).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(letters) == 1) != tt.deadLetter || len(letters) > 1 {
+				t.Fatalf("got %d dead letters, want dead letter %v", len(letters), tt.deadLetter)
+			}
+			if tt.deadLetter {
+				var letter webhookDeadLetter
+				if err := json.Unmarshal([]byte(letters[0]), &letter); err != nil {
+					t.Fatal(err)
+				}
+				if letter.Attempts != tt.attempts || letter.WebhookID != hook.Webhook.ID || len(letter.Payload) == 0 {
+					t.Errorf("dead letter %+v", letter)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookRefusesPrivateReceivers(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	s, _ := newTestServer(t, nil)
+	webhooks := newWebhooks(s.redis, false, time.Millisecond)
+	hook, err := webhooks.Create(context.Background(), receiver.URL, []WebhookEvent{WebhookEventMessagePosted}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery, err := webhooks.Test(context.Background(), hook.Webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Success || delivery.Error == nil || len(receiver.requests) != 0 {
+		t.Errorf("delivered to loopback receiver: %+v", delivery)
+	}
+}
+
+func TestWebhookPayloadsOmitModeration(t *testing.T) {
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	wordlist := writeConfigFile(t, "words.txt", "spamword\n")
+	s, _ := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.ModerationWordlist = wordlist
+		cfg.ModerationWordlistAction = "flag"
+		cfg.WebhookAllowPrivate = true
+	})
+	ctx := context.Background()
+	if _, err := s.webhooks.Create(ctx, receiver.URL, []WebhookEvent{WebhookEventMessagePosted, WebhookEventMessageUpdated}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	id := postTestMessage(t, s, "alice", "a spamword message")
+	msg, err := s.resolver.loadMessage(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.resolver.hideMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	s.webhooks.wg.Wait()
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if len(receiver.bodies) != 2 {
+		t.Fatalf("got %d deliveries, want posted and updated", len(receiver.bodies))
+	}
+	for _, body := range receiver.bodies {
+		if !strings.Contains(string(body), id) || strings.Contains(string(body), "moderation") {
+			t.Errorf("payload %s, want the message without its moderation", body)
+		}
+	}
+	// The stored message keeps it
+	if msg, err = s.resolver.loadMessage(ctx, id); err != nil || msg.Moderation == nil {
+		t.Errorf("stored moderation %+v, %v", msg, err)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/gorilla/websocket"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const (
+	// websocketInitTimeout is how long a client has to send connection_init
+	websocketInitTimeout = 10 * time.Second
+
+	// websocketPingInterval is how often idle connections are pinged. With
+	// graphql-transport-ws a client that doesn't answer within two intervals
+	// is disconnected, graphql-ws clients only receive keep-alives.
+	websocketPingInterval = 10 * time.Second
+
+	// websocketDrainPeriod is how long Shutdown waits for complete messages
+	// to be written before closing the connections
+	websocketDrainPeriod = 500 * time.Millisecond
+
+	// closeForbidden is the close code graphql-transport-ws uses for a
+	// rejected connection_init
+	closeForbidden = 4403
+)
+
+// websocketSubprotocols are the subprotocols in order of preference, the
+// same order gqlgen would pick them in
+var websocketSubprotocols = []string{"graphql-ws", "graphql-transport-ws"}
+
+// websocketTransport serves subscriptions over both graphql-transport-ws and
+// the legacy graphql-ws subprotocol, picked by the client's
+// Sec-WebSocket-Protocol header. Clients that send neither get graphql-ws.
+func (s *Server) websocketTransport() transport.Websocket {
+	upgrader := s.upgrader
+	upgrader.Subprotocols = websocketSubprotocols
+	return transport.Websocket{
+		Upgrader:              upgrader,
+		InitFunc:              s.websocketInit,
+		InitTimeout:           websocketInitTimeout,
+		KeepAlivePingInterval: websocketPingInterval,
+		PingPongInterval:      websocketPingInterval,
+		ErrorFunc: func(ctx context.Context, err error) {
+			slog.DebugContext(ctx, "Websocket error", "error", err)
+		},
+		CloseFunc: func(ctx context.Context, code int) {
+			slog.DebugContext(ctx, "Websocket closed", "code", code)
+		},
+	}
+}
+
+// websocketInit authenticates a connection when the client sends
+// connection_init. The connection keeps the identity of the upgrade request's
+// session cookie, unless the payload has an Authorization entry with an
+// access token, since browsers can't send headers with the upgrade. Clients
+// may send their user in the payload to make sure the cookie belongs to the
+// same session, a mismatch rejects the connection.
+func (s *Server) websocketInit(ctx context.Context, payload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+	if s.resolver.isClosing() {
+		return ctx, nil, rejectWebsocket(ctx, websocket.CloseGoingAway, errors.New("server is shutting down"))
+	}
+
+	client := ClientFromContext(ctx)
+	if authorization := payload.Authorization(); authorization != "" {
+		token, err := s.resolver.authenticateToken(ctx, authorization)
+		if err != nil {
+			if !errors.Is(err, errInvalidToken) {
+				slog.ErrorContext(ctx, "Failed to look up access token", "error", err)
+			}
+			return ctx, nil, rejectWebsocket(ctx, closeForbidden, invalidTokenError())
+		}
+		authenticated := *client
+		authenticated.User = token.User
+		authenticated.Token = token
+		client = &authenticated
+		ctx = context.WithValue(ctx, clientContextKey, client)
+	}
+	if claimed, ok := payload["user"].(string); ok && claimed != "" && claimed != client.User {
+		slog.WarnContext(ctx, "Rejected websocket with mismatched user", "claimed", claimed)
+		return ctx, nil, rejectWebsocket(ctx, closeForbidden, forbiddenError("user does not match the session"))
+	}
+
+	slog.DebugContext(ctx, "Websocket initialized")
+	return ctx, nil, nil
+}
+
+// rejectWebsocket closes a graphql-transport-ws connection with code, since
+// gqlgen closes every rejected connection with 1000, which clients take as a
+// reason to reconnect. graphql-ws connections are left to gqlgen, which
+// sends err as connection_error first.
+func rejectWebsocket(ctx context.Context, code int, err error) error {
+	upgraded, ok := ctx.Value(upgradedConnKey{}).(*upgradedConn)
+	if !ok || upgraded.protocol != "graphql-transport-ws" {
+		return err
+	}
+
+	reason := err.Error()
+	var gqlErr *gqlerror.Error
+	if errors.As(err, &gqlErr) {
+		reason = gqlErr.Message
+	}
+	upgraded.close(code, reason)
+	return err
+}
+
+type upgradedConnKey struct{}
+
+// upgradedConn is the connection of a websocket upgrade, which gqlgen
+// doesn't expose to InitFunc
+type upgradedConn struct {
+	protocol string
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+// close writes a close frame and closes the connection. Nothing else writes
+// to it while connection_init is handled.
+func (u *upgradedConn) close(code int, reason string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.conn == nil {
+		return
+	}
+
+	// Control frames carry at most 125 bytes, two of which are the code
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := websocket.FormatCloseMessage(code, reason)
+	frame := append([]byte{0x88, byte(len(payload))}, payload...)
+
+	u.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	u.conn.Write(frame)
+	u.conn.Close()
+	u.conn = nil
+}
+
+// recordUpgrades stores the connection of websocket upgrades in the request
+// context, so websocketInit can close it with the code the subprotocol
+// expects
+func recordUpgrades(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		upgraded := &upgradedConn{protocol: negotiatedSubprotocol(r)}
+		ctx := context.WithValue(r.Context(), upgradedConnKey{}, upgraded)
+		next.ServeHTTP(&hijackRecorder{ResponseWriter: w, hijacker: hijacker, upgraded: upgraded}, r.WithContext(ctx))
+	})
+}
+
+// negotiatedSubprotocol returns the subprotocol the upgrader picks for r
+func negotiatedSubprotocol(r *http.Request) string {
+	offered := websocket.Subprotocols(r)
+	for _, protocol := range websocketSubprotocols {
+		if slices.Contains(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+type hijackRecorder struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+	upgraded *upgradedConn
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.hijacker.Hijack()
+	if err == nil {
+		w.upgraded.mutex.Lock()
+		w.upgraded.conn = conn
+		w.upgraded.mutex.Unlock()
+	}
+	return conn, rw, err
+}
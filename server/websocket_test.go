@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsMessage struct {
+	ID      string                 `json:"id,omitempty"`
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+// dialWebsocket opens a websocket to /graphql as alice with subprotocol
+func dialWebsocket(t *testing.T, s *Server, subprotocol string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(s.handler)
+	t.Cleanup(server.Close)
+
+	header := http.Header{}
+	header.Set("Cookie", sessionFor(s, "alice").String())
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/graphql", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if conn.Subprotocol() != subprotocol {
+		t.Fatalf("negotiated %q, want %q", conn.Subprotocol(), subprotocol)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// readWebsocket returns the next message that isn't a keep-alive
+func readWebsocket(t *testing.T, conn *websocket.Conn) (wsMessage, error) {
+	t.Helper()
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return msg, err
+		}
+		if msg.Type != "ka" && msg.Type != "ping" && msg.Type != "pong" {
+			return msg, nil
+		}
+	}
+}
+
+// keepPosting posts messages as bob until the test ends, since the
+// subscription is registered some time after the client starts it
+func keepPosting(t *testing.T, s *Server) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				body, _ := json.Marshal(map[string]interface{}{
+					"query":     postMessageMutation,
+					"variables": map[string]interface{}{"user": "bob", "text": fmt.Sprintf("hello number %d", i)},
+				})
+				req := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				req.AddCookie(sessionFor(s, "bob"))
+				s.handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}
+	}()
+}
+
+func TestWebsocketSubscriptions(t *testing.T) {
+	tests := []struct {
+		subprotocol string
+		start       string
+		data        string
+	}{
+		{"graphql-transport-ws", "subscribe", "next"},
+		{"graphql-ws", "start", "data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subprotocol, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+			conn := dialWebsocket(t, s, tt.subprotocol)
+
+			if err := conn.WriteJSON(wsMessage{Type: "connection_init", Payload: map[string]interface{}{"user": "alice"}}); err != nil {
+				t.Fatal(err)
+			}
+			if msg, err := readWebsocket(t, conn); err != nil || msg.Type != "connection_ack" {
+				t.Fatalf("got %+v, %v, want connection_ack", msg, err)
+			}
+
+			err := conn.WriteJSON(wsMessage{ID: "1", Type: tt.start, Payload: map[string]interface{}{
+				"query": `subscription { messagePosted(user: "alice") { user text } }`,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keepPosting(t, s)
+
+			msg, err := readWebsocket(t, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != tt.data || msg.ID != "1" || !strings.Contains(fmt.Sprint(msg.Payload), "user:bob") {
+				t.Errorf("got %+v, want %s with bob's message", msg, tt.data)
+			}
+		})
+	}
+}
+
+func TestWebsocketRejectedInit(t *testing.T) {
+	payloads := map[string]map[string]interface{}{
+		"invalid token":   {"Authorization": "Bearer invalid"},
+		"mismatched user": {"user": "mallory"},
+	}
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newTestServer(t, nil)
+
+			// graphql-transport-ws clients only stop reconnecting on 4403
+			conn := dialWebsocket(t, s, "graphql-transport-ws")
+			if err := conn.WriteJSON(wsMessage{Type: "connection_init", Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readWebsocket(t, conn)
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != closeForbidden {
+				t.Errorf("got %v, want close %d", err, closeForbidden)
+			}
+
+			// graphql-ws has no close codes and reports connection_error
+			conn = dialWebsocket(t, s, "graphql-ws")
+			if err := conn.WriteJSON(wsMessage{Type: "connection_init", Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			if msg, err := readWebsocket(t, conn); err != nil || msg.Type != "connection_error" {
+				t.Errorf("got %+v, %v, want connection_error", msg, err)
+			}
+		})
+	}
+}
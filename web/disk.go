@@ -0,0 +1,11 @@
+//go:build !embedfrontend
+
+package web
+
+import "io/fs"
+
+// Assets returns nil since the frontend isn't embedded in this build, it's
+// served from STATIC_DIR instead
+func Assets() fs.FS {
+	return nil
+}
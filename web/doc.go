@@ -0,0 +1,3 @@
+// Package web holds the built frontend when it's compiled into the binary
+// with the embedfrontend build tag
+package web